@@ -1,36 +1,39 @@
 package main
 
+/*
+#include <stdlib.h>
+*/
+import "C"
+
 import (
+	"errors"
 	"fmt"
 	"unsafe"
 
 	"github.com/vxcontrol/golua/lua"
 )
 
-var refHolder = map[unsafe.Pointer][]byte{}
+var allocated int
 
-// AllocatorF a terrible allocator!
-//meant to be illustrative of the mechanics,
-//not usable as an actual implementation
+// AllocatorF an allocator counting the allocated bytes.
+// Lua keeps the returned pointers, so the memory must be allocated
+// by C: Go memory can be moved or collected by the Go runtime.
 func AllocatorF(ptr unsafe.Pointer, osize uint, nsize uint) unsafe.Pointer {
+	if ptr != nil {
+		allocated -= int(osize)
+	}
 	if nsize == 0 {
-		if _, ok := refHolder[ptr]; ok {
-			delete(refHolder, ptr)
-		}
-		ptr = unsafe.Pointer(nil)
-	} else if osize != nsize {
-		slice := make([]byte, nsize)
-
-		if oldslice, ok := refHolder[ptr]; ok {
-			copy(slice, oldslice)
-			_ = oldslice
-			delete(refHolder, ptr)
-		}
-
-		ptr = unsafe.Pointer(&(slice[0]))
-		refHolder[ptr] = slice
+		C.free(ptr)
+		return nil
 	}
-	return ptr
+	nptr := C.realloc(ptr, C.size_t(nsize))
+	if nptr == nil {
+		// the old block is still in use
+		allocated += int(osize)
+		return nil
+	}
+	allocated += int(nsize)
+	return nptr
 }
 
 // A2 a wrapper to allocator
@@ -51,5 +54,10 @@ func main() {
 		L.Call(1, 0)
 	}
 
-	fmt.Println(len(refHolder))
+	fmt.Println(allocated, L.MemoryUsage())
+
+	// the memory used by scripts can be limited with any allocator
+	L.SetMemoryLimit(L.MemoryUsage() + 1024*1024)
+	err := L.DoString(`s = string.rep("x", 2 * 1024 * 1024)`)
+	fmt.Println(errors.Is(err, lua.ErrMemoryLimit))
 }
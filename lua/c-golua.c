@@ -28,8 +28,34 @@ static const char GoWithinStateUniqArrayKey = 'u'; //golua registry key, uniq ar
 // lightuserdata key.
 static const char GoWithinStateRevUniqMap = 'r'; //in golua registry, reverse uniq map
 
+// Within one main state, maps the coroutines of
+// uniqArray (weak keys) to a userdata whose __gc
+// releases the go side of the coroutine once it has
+// been collected.
+// Stored in the per state Lua registry.
+// The address of this constant is used as a unique
+// lightuserdata key.
+static const char GoWithinStateCoroSentinelsKey = 's';
+
+#define MT_COROSENTINEL "GoLua.CoroSentinel"
+
+// Within one main state, the coroutines suspended
+// by YieldWith (weak keys): they must be resumed from go.
+// The address of this constant is used as a unique
+// lightuserdata key.
+static const char GoWithinStateYieldWithKey = 'y';
+
+#define YIELDWITH_RESUME_ERROR "cannot resume a coroutine suspended by YieldWith from lua"
+
 static const char PanicFIDRegistryKey = 'k';
 
+/* from luajit.h, which isn't shipped with the headers */
+#define LUAJIT_MODE_ENGINE 0
+#define LUAJIT_MODE_OFF 0x0000
+#define LUAJIT_MODE_ON 0x0100
+#define LUAJIT_MODE_FLUSH 0x0200
+LUA_API int luaJIT_setmode(lua_State *L, int idx, int mode);
+
 /* makes sure we compile in atoll/_atoi64 if available.*/
 long long int wrapAtoll(const char *nptr)
 {
@@ -150,7 +176,11 @@ int callback_function(lua_State* coro)
 	//remove the userdata metatable (go function??) from the stack (to present same behavior as lua_CFunctions)
 	lua_remove(coro, 1);
 
-	return golua_callgofunction(coro, coro_index, main_index, main_thread, fid!=NULL ? *fid : -1);
+	r = golua_callgofunction(coro, coro_index, main_index, main_thread, fid!=NULL ? *fid : -1);
+	// the go function raised an error, its value is on the top of the stack
+	if (r < 0 && lua_status(coro) != LUA_YIELD)
+		return lua_error(coro);
+	return r;
 }
 
 //wrapper for gchook
@@ -188,12 +218,16 @@ void clua_pushgofunction(lua_State* L, unsigned int fid)
 
 static int callback_c(lua_State* coro)
 {
+	int r;
 	int fid = clua_togofunction(coro, lua_upvalueindex(1));
 	size_t coro_index = clua_getgostate(coro);
 	lua_State*  main_thread = clua_get_main_thread(coro);
 	size_t main_index = clua_getgostate(main_thread);
 
-	return golua_callgofunction(coro, coro_index, main_index, main_thread, fid);
+	r = golua_callgofunction(coro, coro_index, main_index, main_thread, fid);
+	if (r < 0 && lua_status(coro) != LUA_YIELD)
+		return lua_error(coro);
+	return r;
 }
 
 void clua_pushcallback(lua_State* L)
@@ -201,6 +235,74 @@ void clua_pushcallback(lua_State* L)
 	lua_pushcclosure(L, callback_c, 1);
 }
 
+// the table accesses of clua_pushtableaccess
+#define TABLE_GET 0
+#define TABLE_SET 1
+#define TABLE_RAWGET 2
+#define TABLE_RAWSET 3
+
+static int table_access(lua_State* L)
+{
+	// arguments: table, key and value for the assignments
+	switch (lua_tointeger(L, lua_upvalueindex(1)))
+	{
+	case TABLE_GET:
+		lua_gettable(L, 1);
+		return 1;
+	case TABLE_SET:
+		lua_settable(L, 1);
+		return 0;
+	case TABLE_RAWGET:
+		lua_rawget(L, 1);
+		return 1;
+	default:
+		lua_rawset(L, 1);
+		return 0;
+	}
+}
+
+// pushes a function doing the access op to the table of its arguments,
+// so the errors of the access can be caught by a protected call
+void clua_pushtableaccess(lua_State* L, int op)
+{
+	lua_pushinteger(L, op);
+	lua_pushcclosure(L, &table_access, 1);
+}
+
+static int raisederror_method(lua_State* L)
+{
+	// the string method is called with the message of the error
+	if (luaL_callmeta(L, 1, "__tostring"))
+		lua_replace(L, 1);
+	lua_pushvalue(L, lua_upvalueindex(1));
+	lua_insert(L, 1);
+	lua_call(L, lua_gettop(L) - 1, LUA_MULTRET);
+	return lua_gettop(L);
+}
+
+static int raisederror_index(lua_State* L)
+{
+	lua_getfield(L, LUA_REGISTRYINDEX, "_LOADED");
+	lua_getfield(L, -1, "string");
+	if (!lua_istable(L, -1))
+		return 0;
+	lua_pushvalue(L, 2);
+	lua_rawget(L, -2);
+	if (!lua_isfunction(L, -1))
+		return 0;
+	lua_pushcclosure(L, &raisederror_method, 1);
+	return 1;
+}
+
+// sets the __index of the metatable on top of the stack of the Go errors
+// raised into lua: their methods are the string ones, err:find("x") works
+// like with an error message
+void clua_setraisederrorindex(lua_State* L)
+{
+	lua_pushcfunction(L, &raisederror_index);
+	lua_setfield(L, -2, "__index");
+}
+
 void clua_pushgostruct(lua_State* L, unsigned int iid)
 {
 	unsigned int* iidptr = (unsigned int *)lua_newuserdata(L, sizeof(unsigned int));
@@ -222,13 +324,26 @@ int default_panicf(lua_State *L)
 	return 0;
 }
 
+// true when the error is raised by a go function, not by lua code raising
+// it again: the message handler runs at level 0 above the raising function
+static int raised_by_gofunction(lua_State *L)
+{
+	lua_Debug ar;
+	lua_CFunction f;
+	if (!lua_getstack(L, 1, &ar) || !lua_getinfo(L, "f", &ar))
+		return 0;
+	f = lua_tocfunction(L, -1);
+	lua_pop(L, 1);
+	return f == &callback_c || f == &callback_function;
+}
+
 int panic_msghandler(lua_State *L)
 {
 	char *s = (char *)lua_tolstring(L, -1, NULL);
 	lua_State* main_thread = clua_get_main_thread(L);
 	size_t main_index = clua_getgostate(main_thread);
 
-	go_panic_msghandler(L, main_index, s);
+	go_panic_msghandler(L, main_index, s, raised_by_gofunction(L));
 	return 1;
 }
 
@@ -272,10 +387,30 @@ GoValue clua_atpanic(lua_State* L, unsigned int panicf_id)
 		return (GoValue){2, pf};
 }
 
+// sets a metatable with __mode = mode to the table at the top of the stack
+static void set_weak_mode(lua_State* L, const char* mode) {
+	lua_newtable(L);
+	lua_pushstring(L, mode);
+	lua_setfield(L, -2, "__mode");
+	lua_setmetatable(L, -2);
+}
+
+// __gc of the sentinel of a coroutine: the coroutine has been collected
+static int coro_sentinel_gc(lua_State* L) {
+	int* upos = (int*)lua_touserdata(L, 1);
+	lua_State* main_thread = clua_get_main_thread(L);
+	if (upos != NULL && main_thread != NULL)
+		golua_corogc(clua_getgostate(main_thread), *upos);
+	return 0;
+}
+
 void create_uniq_array(lua_State* L) {
 	// stack: ...
 
+	// uniqArray and revUniqMap don't keep the coroutines alive,
+	// the main state at uniqArray[1] can't be collected anyway.
 	lua_newtable(L);
+	set_weak_mode(L, "v");
 	// stack: newtable, ...
 
 	lua_pushlightuserdata(L, (void*)&GoWithinStateUniqArrayKey);
@@ -289,6 +424,7 @@ void create_uniq_array(lua_State* L) {
 
 	// and create the reverse uniq map: *lua_State -> uPos
 	lua_newtable(L);
+	set_weak_mode(L, "k");
 	// stack: newtable, ...
 
 	lua_pushlightuserdata(L, (void*)&GoWithinStateRevUniqMap);
@@ -299,6 +435,18 @@ void create_uniq_array(lua_State* L) {
 
 	lua_settable(L, LUA_REGISTRYINDEX);
 	// stack: ...
+
+	// and the sentinels of the coroutines: *lua_State -> sentinel
+	lua_pushlightuserdata(L, (void*)&GoWithinStateCoroSentinelsKey);
+	lua_newtable(L);
+	set_weak_mode(L, "k");
+	lua_settable(L, LUA_REGISTRYINDEX);
+
+	luaL_newmetatable(L, MT_COROSENTINEL);
+	lua_pushcfunction(L, &coro_sentinel_gc);
+	lua_setfield(L, -2, "__gc");
+	lua_pop(L, 1);
+	// stack: ...
 }
 
 // return 1 if created, 0 if already existed.
@@ -396,12 +544,18 @@ int clua_add_thread_to_uniq_array_and_rev_uniq(lua_State* L) {
 	lua_pushthread(L);
 	// stack: thread, uniqArray, ...
 
-	// append to array at -2
-	int pos = lua_objlen(L, -2) + 1; /* first empty element */
+	// append to array at -2, the collected coroutines leave holes
+	// so the last position is kept in uniqArray.n
+	lua_getfield(L, -2, "n");
+	int pos = (int)lua_tointeger(L, -1) + 1; /* first never used element */
+	lua_pop(L, 1);
 
 	lua_rawseti(L, -2, pos);  /* t[pos] = v; and pops v from the top of the stack*/
 	// stack: uniqArray, ...
 
+	lua_pushinteger(L, pos);
+	lua_setfield(L, -2, "n");
+
 	lua_pop(L, 1);
 	// stack: ...
 
@@ -423,6 +577,25 @@ int clua_add_thread_to_uniq_array_and_rev_uniq(lua_State* L) {
 	lua_settable(L, -3);
 	// stack: revUniqMap, ...
 
+	// Phase 3:
+	//
+	// the sentinel of a coroutine is released with it
+	if (pos > 1) {
+		lua_pushlightuserdata(L, (void*)&GoWithinStateCoroSentinelsKey);
+		lua_gettable(L, LUA_REGISTRYINDEX);
+		// stack: sentinels, revUniqMap, ...
+
+		lua_pushthread(L);
+		int* upos = (int*)lua_newuserdata(L, sizeof(int));
+		*upos = pos;
+		luaL_getmetatable(L, MT_COROSENTINEL);
+		lua_setmetatable(L, -2);
+		// stack: sentinel, thread, sentinels, revUniqMap, ...
+
+		lua_settable(L, -3);
+		// stack: sentinels, revUniqMap, ...
+	}
+
 	lua_settop(L, top);
 	// stack clean
 
@@ -542,17 +715,11 @@ int interface_index_callback(lua_State *L)
 		return 1;
 	}
 
-	char *field_name = (char *)lua_tostring(L, 2);
-	if (field_name == NULL)
-	{
-		lua_pushnil(L);
-		return 1;
-	}
-
+	// the key (field name, slice index or map key) is read from the stack by the go side
 	lua_State* main_thread = clua_get_main_thread(L);
 	size_t main_index = clua_getgostate(main_thread);
 
-	int r = golua_interface_index_callback(L, main_index, *iid, field_name);
+	int r = golua_interface_index_callback(L, main_index, *iid);
 
 	if (r < 0)
 	{
@@ -575,17 +742,11 @@ int interface_newindex_callback(lua_State *L)
 		return 1;
 	}
 
-	char *field_name = (char *)lua_tostring(L, 2);
-	if (field_name == NULL)
-	{
-		lua_pushnil(L);
-		return 1;
-	}
-
+	// the key (field name, slice index or map key) is read from the stack by the go side
 	lua_State* main_thread = clua_get_main_thread(L);
 	size_t main_index = clua_getgostate(main_thread);
 
-	int r = golua_interface_newindex_callback(L, main_index, *iid, field_name);
+	int r = golua_interface_newindex_callback(L, main_index, *iid);
 
 	if (r < 0)
 	{
@@ -598,17 +759,131 @@ int interface_newindex_callback(lua_State *L)
 	}
 }
 
-void clua_hide_pcall(lua_State *L)
+// the errors of the go functions are raised with lua_error, so pcall and xpcall are safe to use.
+// unsafe_pcall and unsafe_xpcall are kept as aliases for the scripts written for the previous versions.
+// on windows lua_error isn't used (see golua_callgofunction) and pcall and xpcall are still hidden.
+void clua_alias_pcall(lua_State *L)
 {
 	lua_getglobal(L, "pcall");
 	lua_setglobal(L, "unsafe_pcall");
-	lua_pushnil(L);
-	lua_setglobal(L, "pcall");
 
 	lua_getglobal(L, "xpcall");
 	lua_setglobal(L, "unsafe_xpcall");
+
+#ifdef _WIN32
+	lua_pushnil(L);
+	lua_setglobal(L, "pcall");
 	lua_pushnil(L);
 	lua_setglobal(L, "xpcall");
+#endif
+}
+
+// marks the coroutine L as suspended by YieldWith (on) or not
+void clua_markyieldwith(lua_State* L, int on)
+{
+	lua_pushlightuserdata(L, (void*)&GoWithinStateYieldWithKey);
+	lua_rawget(L, LUA_REGISTRYINDEX);
+	if (!lua_istable(L, -1)) {
+		lua_pop(L, 1);
+		lua_newtable(L);
+		set_weak_mode(L, "k");
+		lua_pushlightuserdata(L, (void*)&GoWithinStateYieldWithKey);
+		lua_pushvalue(L, -2);
+		lua_rawset(L, LUA_REGISTRYINDEX);
+	}
+	lua_pushthread(L);
+	if (on)
+		lua_pushboolean(L, 1);
+	else
+		lua_pushnil(L);
+	lua_rawset(L, -3);
+	lua_pop(L, 1);
+}
+
+// returns 1 when the coroutine at index is suspended by YieldWith
+static int suspended_by_yieldwith(lua_State* L, int index)
+{
+	int r;
+	lua_pushlightuserdata(L, (void*)&GoWithinStateYieldWithKey);
+	lua_rawget(L, LUA_REGISTRYINDEX);
+	if (!lua_istable(L, -1) || !lua_isthread(L, index)) {
+		lua_pop(L, 1);
+		return 0;
+	}
+	lua_pushvalue(L, index);
+	lua_rawget(L, -2);
+	r = lua_toboolean(L, -1);
+	lua_pop(L, 2);
+	return r;
+}
+
+// coroutine.resume, upvalue 1 is the original function
+static int guarded_resume(lua_State* L)
+{
+	if (suspended_by_yieldwith(L, 1)) {
+		lua_pushboolean(L, 0);
+		lua_pushliteral(L, YIELDWITH_RESUME_ERROR);
+		return 2;
+	}
+	lua_pushvalue(L, lua_upvalueindex(1));
+	lua_insert(L, 1);
+	lua_call(L, lua_gettop(L) - 1, LUA_MULTRET);
+	return lua_gettop(L);
+}
+
+// the function returned by coroutine.wrap, upvalue 1 is the coroutine
+// and upvalue 2 the original coroutine.resume
+static int guarded_wrap_aux(lua_State* L)
+{
+	if (suspended_by_yieldwith(L, lua_upvalueindex(1)))
+		return luaL_error(L, YIELDWITH_RESUME_ERROR);
+	lua_pushvalue(L, lua_upvalueindex(2));
+	lua_pushvalue(L, lua_upvalueindex(1));
+	lua_insert(L, 1);
+	lua_insert(L, 1);
+	lua_call(L, lua_gettop(L) - 1, LUA_MULTRET);
+	if (!lua_toboolean(L, 1)) {
+		lua_settop(L, 2);
+		if (lua_isstring(L, 2)) {
+			luaL_where(L, 1);
+			lua_insert(L, -2);
+			lua_concat(L, 2);
+		}
+		return lua_error(L);
+	}
+	return lua_gettop(L) - 1;
+}
+
+// coroutine.wrap, upvalue 1 is the original coroutine.resume
+static int guarded_wrap(lua_State* L)
+{
+	lua_State* co;
+	luaL_checktype(L, 1, LUA_TFUNCTION);
+	co = lua_newthread(L);
+	lua_pushvalue(L, 1);
+	lua_xmove(L, co, 1);
+	lua_pushvalue(L, lua_upvalueindex(1));
+	lua_pushcclosure(L, &guarded_wrap_aux, 2);
+	return 1;
+}
+
+// the coroutines suspended by YieldWith can't be resumed from lua:
+// coroutine.resume returns false with an error and the functions of
+// coroutine.wrap raise it.
+void clua_guard_resume(lua_State *L)
+{
+	lua_getglobal(L, "coroutine");
+	if (!lua_istable(L, -1)) {
+		lua_pop(L, 1);
+		return;
+	}
+	lua_getfield(L, -1, "resume");
+	lua_pushvalue(L, -1);
+	lua_pushcclosure(L, &guarded_resume, 1);
+	lua_setfield(L, -3, "resume");
+	lua_pushcclosure(L, &guarded_wrap, 1);
+	lua_setfield(L, -2, "wrap");
+	lua_pop(L, 1);
 }
 
 void clua_initstate(lua_State* L)
@@ -663,17 +938,57 @@ lua_State* clua_newstate(void* goallocf)
 	return lua_newstate(&allocwrapper, goallocf);
 }
 
+static void* memlimit_alloc(void* ud, void *ptr, size_t osize, size_t nsize);
+
 void clua_setallocf(lua_State* L, void* goallocf)
 {
+	void* ud;
+	/* keeps counting the memory with the new allocation function */
+	if (lua_getallocf(L, &ud) == &memlimit_alloc)
+	{
+		((clua_memlimit*)ud)->f = &allocwrapper;
+		((clua_memlimit*)ud)->ud = goallocf;
+		return;
+	}
 	lua_setallocf(L, &allocwrapper, goallocf);
 }
 
+static void* memlimit_alloc(void* ud, void *ptr, size_t osize, size_t nsize)
+{
+	clua_memlimit* m = (clua_memlimit*)ud;
+	void* p;
+	if (nsize > osize && m->limit > 0 && m->used + (nsize - osize) > m->limit)
+	{
+		m->refused = 1;
+		return NULL;
+	}
+	p = m->f(m->ud, ptr, osize, nsize);
+	if (p != NULL || nsize == 0)
+		m->used = m->used - osize + nsize;
+	return p;
+}
+
+/* wraps the allocation function of the state to count the allocated bytes and refuse the ones past limit */
+clua_memlimit* clua_setmemlimit(lua_State* L)
+{
+	clua_memlimit* m = (clua_memlimit*)malloc(sizeof(clua_memlimit));
+	if (m == NULL)
+		return NULL;
+	m->f = lua_getallocf(L, &m->ud);
+	m->used = (size_t)lua_gc(L, LUA_GCCOUNT, 0) * 1024 + (size_t)lua_gc(L, LUA_GCCOUNTB, 0);
+	m->limit = 0;
+	m->refused = 0;
+	lua_setallocf(L, &memlimit_alloc, m);
+	return m;
+}
+
 void clua_openbase(lua_State* L)
 {
 	lua_pushcfunction(L, &luaopen_base);
 	lua_pushstring(L, "");
 	lua_call(L, 1, 0);
-	clua_hide_pcall(L);
+	clua_alias_pcall(L);
+	clua_guard_resume(L);
 }
 
 void clua_openio(lua_State* L)
@@ -724,12 +1039,54 @@ void clua_hook_function(lua_State *L, lua_Debug *ar)
 	lua_State* main_thread = clua_get_main_thread(L);
 	size_t main_index = clua_getgostate(main_thread);
 
-	golua_callgohook(L, main_index);
+	// a hook aborted the execution, its error message is on the top of the stack
+	if (golua_callgohook(L, main_index, ar) < 0)
+		lua_error(L);
+}
+
+void clua_sethook(lua_State* L, int mask, int count)
+{
+	if (mask != 0)
+		lua_sethook(L, &clua_hook_function, mask, count);
+	else
+		lua_sethook(L, NULL, 0, 0);
 }
 
-void clua_sethook(lua_State* L, int n)
+void clua_hookinfo(lua_State* L, lua_Debug *ar)
 {
-	lua_sethook(L, &clua_hook_function, LUA_MASKCOUNT, n);
+	lua_getinfo(L, "nSl", ar);
+}
+
+// hooks aren't called from JIT compiled code, so the JIT compiler must be off while they are set.
+// returns 1 if the JIT compiler was on and has been turned off.
+int clua_jit_suspend(lua_State* L)
+{
+	/* the JIT compiler is on by default, jit.status tells if it's been turned off */
+	int on = 1;
+	int top = lua_gettop(L);
+	lua_getfield(L, LUA_REGISTRYINDEX, "_LOADED");
+	if (lua_istable(L, -1))
+	{
+		lua_getfield(L, -1, "jit");
+		if (lua_istable(L, -1))
+		{
+			lua_getfield(L, -1, "status");
+			if (lua_isfunction(L, -1) && lua_pcall(L, 0, 1, 0) == 0)
+				on = lua_toboolean(L, -1);
+		}
+	}
+	lua_settop(L, top);
+	if (on)
+	{
+		luaJIT_setmode(L, 0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_FLUSH);
+		luaJIT_setmode(L, 0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_OFF);
+	}
+	return on;
+}
+
+void clua_jit_resume(lua_State* L)
+{
+	luaJIT_setmode(L, 0, LUAJIT_MODE_ENGINE|LUAJIT_MODE_ON);
 }
 
 /*return the ctype of the cdata at the top of the stack*/
@@ -776,30 +1133,55 @@ static int writer(lua_State *L, const void* b, size_t size, void* B) {
 	return 0;
 }
 
-// load function chunk dumped from dump_chunk
+// load function chunk dumped from dump_chunk, like lua_load the error message is pushed on failure
 int load_chunk(lua_State *L, char *b, int size, const char* chunk_name) {
 	chunk ck;
 	ck.buffer = b;
 	ck.size = size;
-	int err;
-	err = lua_load(L, reader, &ck, chunk_name);
-	if (err != 0) {
-		return luaL_error(L, "unable to load chunk, err: %d", err);
-	}
-	return 0;
+	return lua_load(L, reader, &ck, chunk_name);
 }
 
-// dump function chunk from luaL_loadstring
-int dump_chunk(lua_State *L) {
+static int dump_function(lua_State *L) {
 	luaL_Buffer b;
-	luaL_checktype(L, -1, LUA_TFUNCTION);
-	lua_settop(L, -1);
-	luaL_buffinit(L, &b);
-	int err;
-	err = lua_dump(L, writer, &b);
-	if (err != 0){
-		return luaL_error(L, "unable to dump given function, err:%d", err);
+	luaL_checktype(L, 1, LUA_TFUNCTION);
+	if (lua_toboolean(L, 2)) {
+		/* lua_dump can't strip the debug information, string.dump can */
+		lua_getfield(L, LUA_REGISTRYINDEX, "_LOADED");
+		lua_getfield(L, -1, "string");
+		if (!lua_istable(L, -1))
+			return luaL_error(L, "stripping the debug information needs the string library");
+		lua_getfield(L, -1, "dump");
+		lua_pushvalue(L, 1);
+		lua_pushboolean(L, 1);
+		lua_call(L, 2, 1);
+		return 1;
 	}
+	lua_settop(L, 1);
+	luaL_buffinit(L, &b);
+	if (lua_dump(L, writer, &b) != 0)
+		return luaL_error(L, "unable to dump given function");
 	luaL_pushresult(&b);
-	return 0;
+	return 1;
+}
+
+// dump function chunk from luaL_loadstring, the function is at the top of the stack.
+// pushes the chunk, or the error message on failure
+int dump_chunk(lua_State *L) {
+	return clua_dump(L, -1, 0);
+}
+
+// dump the function at index, stripping the debug information if strip is set.
+// pushes the chunk, or the error message on failure
+int clua_dump(lua_State *L, int index, int strip) {
+	if (index < 0 && index > LUA_REGISTRYINDEX)
+		index = lua_gettop(L) + index + 1;
+	lua_pushcfunction(L, &dump_function);
+	lua_pushvalue(L, index);
+	lua_pushboolean(L, strip);
+	return lua_pcall(L, 2, 1, 0);
+}
+
+// luaL_loadbufferx, mode is "t" (text chunks only), "b" (binary chunks only) or "bt"
+int clua_loadchunk(lua_State *L, const char *b, size_t size, const char* chunk_name, const char* mode) {
+	return luaL_loadbufferx(L, b, size, chunk_name, mode);
 }
@@ -0,0 +1,201 @@
+package debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The messages of the Debug Adapter Protocol, only the fields used by the
+// debugger are declared, see https://microsoft.github.io/debug-adapter-protocol/specification
+
+// A request of the client
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// The response to a request
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// An event sent to the client
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type breakpoint struct {
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line,omitempty"`
+	Source   *source `json:"source,omitempty"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type stackFrame struct {
+	ID               int     `json:"id"`
+	Name             string  `json:"name"`
+	Source           *source `json:"source,omitempty"`
+	Line             int     `json:"line"`
+	Column           int     `json:"column"`
+	PresentationHint string  `json:"presentationHint,omitempty"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	PresentationHint   string `json:"presentationHint,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// Arguments of the requests
+
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	Lines       []int              `json:"lines"`
+}
+
+type stackTraceArguments struct {
+	ThreadID   int `json:"threadId"`
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+type scopesArguments struct {
+	FrameID int `json:"frameId"`
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+	Start              int `json:"start"`
+	Count              int `json:"count"`
+}
+
+type threadArguments struct {
+	ThreadID int `json:"threadId"`
+}
+
+// A connection exchanging DAP messages, the writes are serialized
+type conn struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+
+	mu  sync.Mutex
+	seq int
+}
+
+func newConn(rwc io.ReadWriteCloser) *conn {
+	return &conn{rwc: rwc, r: bufio.NewReader(rwc)}
+}
+
+// Maximum size of the content of a message, larger messages are refused
+const maxContentLength = 16 << 20
+
+// Reads the next message, a JSON object preceded by a Content-Length header
+func (c *conn) read(v interface{}) error {
+	length := -1
+	tp := textproto.NewReader(c.r)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("debugger: invalid header %q", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || length < 0 {
+				return fmt.Errorf("debugger: invalid content length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return errors.New("debugger: missing content length")
+	}
+	if length > maxContentLength {
+		return fmt.Errorf("debugger: content length %d exceeds %d", length, maxContentLength)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Writes the message with the next sequence number, set by setSeq
+func (c *conn) write(setSeq func(seq int), v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	setSeq(c.seq)
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.rwc, "Content-Length: %d\r\n\r\n", len(b)); err != nil {
+		return err
+	}
+	_, err = c.rwc.Write(b)
+	return err
+}
+
+func (c *conn) respond(req *request, body interface{}) error {
+	res := &response{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body}
+	return c.write(func(seq int) { res.Seq = seq }, res)
+}
+
+func (c *conn) fail(req *request, msg string) error {
+	res := &response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: msg}
+	return c.write(func(seq int) { res.Seq = seq }, res)
+}
+
+func (c *conn) event(name string, body interface{}) error {
+	ev := &event{Type: "event", Event: name, Body: body}
+	return c.write(func(seq int) { ev.Seq = seq }, ev)
+}
+
+func (c *conn) close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,334 @@
+// Package debugger implements a debugger of lua states serving the Debug
+// Adapter Protocol (DAP), so editors supporting DAP can debug the lua code
+// run by a Go program.
+//
+// Attach installs a line hook on a state, then Listen (or Serve) accepts the
+// DAP clients on a TCP or Unix socket, one at a time:
+//
+//	d := debugger.Attach(L)
+//	defer d.Close()
+//	addr, err := d.Listen("tcp", "127.0.0.1:4711")
+//	...
+//	<-d.Configured() // optionally wait for the client to set its breakpoints
+//	err = L.DoFile("main.lua")
+//
+// The client may set breakpoints by file and line, pause, step in, over and
+// out, and inspect the stack, the locals, the upvalues and the globals. The
+// file of a breakpoint matches the chunks loaded with a "@path" name
+// (LoadFile, DoFile, AddModuleFS...) when both paths are equal or one ends
+// with the other.
+//
+// When the execution stops the goroutine running the state waits in the hook
+// for the client to resume it, the state stays locked: the other goroutines
+// using it are blocked as well. The stack of the coroutine where the
+// execution stopped is shown as a second thread of the client, the first one
+// being the main coroutine.
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vxcontrol/golua/lua"
+)
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+// Ids of the threads of the client
+const (
+	mainThreadID      = 1 // the main coroutine
+	coroutineThreadID = 2 // the coroutine where the execution stopped, if it isn't the main one
+)
+
+// A debugger attached to a lua state, see Attach
+type Debugger struct {
+	L      *lua.State // the main coroutine
+	hookID int
+
+	// set when the hook has something to check: a client is connected and
+	// breakpoints, stepping or a pause are set
+	armed atomic.Bool
+
+	mu          sync.Mutex
+	session     *session
+	breakpoints map[string]map[int]bool // lines of the breakpoints by cleaned path
+	matches     map[string]map[int]bool // lines of the breakpoints by chunk source
+	pause       bool
+	step        stepMode
+	stepCo      *lua.State // coroutine of the step over or out
+	stepCoRef   *lua.Ref   // keeps stepCo alive
+	stepDepth   int        // stack depth of stepCo at the start of the step
+	stop        *stop      // current stop, nil while running
+	listeners   map[net.Listener]bool
+	closed      bool
+
+	configured     chan struct{}
+	configuredOnce sync.Once
+}
+
+// Attaches a debugger to the state of L, it adds a line hook (see
+// lua.State.AddHook) so the JIT compiler is off until Detach.
+func Attach(L *lua.State) *Debugger {
+	d := &Debugger{
+		L:           L.MainCo,
+		breakpoints: make(map[string]map[int]bool),
+		listeners:   make(map[net.Listener]bool),
+		configured:  make(chan struct{}),
+	}
+	d.hookID = L.AddHook(d.hook, lua.LUA_MASKLINE, 0)
+	return d
+}
+
+// Closes the debugger and removes its hook. Like the other methods of the
+// state it must not be called while the state runs in another goroutine.
+func (d *Debugger) Detach() {
+	d.Close()
+	d.L.RemoveHook(d.hookID)
+}
+
+// Listens on the TCP or Unix socket address and serves the DAP clients in
+// the background until Close. Returns the address of the listener, useful
+// with the port 0.
+func (d *Debugger) Listen(network, address string) (net.Addr, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, fmt.Errorf("debugger: unsupported network %q", network)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	go d.Serve(l)
+	return l.Addr(), nil
+}
+
+// Accepts the DAP clients of l and serves them one at a time, until Close
+// or an error of l. l is closed on return, the error is nil after Close.
+func (d *Debugger) Serve(l net.Listener) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	d.listeners[l] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.listeners, l)
+		d.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			d.mu.Lock()
+			closed := d.closed
+			d.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		d.serveConn(c)
+	}
+}
+
+// Closes the listeners and the connection of the client, the execution is
+// resumed if it is stopped. The hook stays set but idle, see Detach.
+func (d *Debugger) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	for l := range d.listeners {
+		l.Close()
+	}
+	s := d.session
+	d.mu.Unlock()
+	if s != nil {
+		s.conn.close()
+	}
+	return nil
+}
+
+// Returns a channel closed when a client has finished its configuration
+// (the configurationDone request), after setting its breakpoints
+func (d *Debugger) Configured() <-chan struct{} {
+	return d.configured
+}
+
+// the line hook
+func (d *Debugger) hook(L1 *lua.State, ev lua.HookEvent) {
+	if ev.Event != lua.LUA_HOOKLINE || !d.armed.Load() {
+		return
+	}
+	if reason := d.check(L1, ev); reason != "" {
+		d.stopAt(L1, reason)
+	}
+}
+
+// returns the reason to stop at the line event ev of L1, "" to go on
+func (d *Debugger) check(L1 *lua.State, ev lua.HookEvent) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return ""
+	}
+	if d.pause {
+		return "pause"
+	}
+	if d.lines(ev.Source)[ev.CurrentLine] {
+		return "breakpoint"
+	}
+	switch d.step {
+	case stepIn:
+		return "step"
+	case stepOver, stepOut:
+		if L1 != d.stepCo {
+			// stops when the coroutine of the step has yielded or returned
+			if d.stepCo.Status() == lua.LUA_YIELD || d.stepCo.GetStack(0) == nil {
+				return "step"
+			}
+			return ""
+		}
+		depth := stackDepth(L1)
+		if depth < d.stepDepth || (d.step == stepOver && depth == d.stepDepth) {
+			return "step"
+		}
+	}
+	return ""
+}
+
+// stops the execution in the coroutine L1 until the client resumes it
+func (d *Debugger) stopAt(L1 *lua.State, reason string) {
+	st := newStop(d, L1)
+	d.mu.Lock()
+	d.pause = false
+	d.setStep(stepNone, nil)
+	s := d.session
+	if s != nil {
+		d.stop = st
+	}
+	d.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	threadID := mainThreadID
+	if L1 != d.L {
+		threadID = coroutineThreadID
+	}
+	s.conn.event("stopped", map[string]interface{}{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+	mode := st.wait()
+	st.release()
+
+	d.mu.Lock()
+	d.stop = nil
+	if d.session == s {
+		d.setStep(mode, L1)
+	}
+	d.mu.Unlock()
+}
+
+// Sets the stepping mode from the coroutine L1, d.mu must be held.
+// Called from the goroutine running the state.
+func (d *Debugger) setStep(mode stepMode, L1 *lua.State) {
+	if d.stepCoRef != nil {
+		d.stepCoRef.Release()
+		d.stepCoRef = nil
+	}
+	d.step, d.stepCo, d.stepDepth = mode, nil, 0
+	if mode == stepOver || mode == stepOut {
+		d.stepCo = L1
+		d.stepDepth = stackDepth(L1)
+		if L1 != d.L {
+			L1.PushThread()
+			d.stepCoRef = L1.NewRef(-1).SetFinalizer()
+			L1.Pop(1)
+		}
+	}
+	d.updateArmed()
+}
+
+// Sets the lines of the breakpoints of the file path, d.mu must be held
+func (d *Debugger) setBreakpoints(path string, lines []int) {
+	path = cleanPath(path)
+	if len(lines) == 0 {
+		delete(d.breakpoints, path)
+	} else {
+		m := make(map[int]bool, len(lines))
+		for _, line := range lines {
+			m[line] = true
+		}
+		d.breakpoints[path] = m
+	}
+	d.matches = nil
+	d.updateArmed()
+}
+
+// Returns the lines of the breakpoints of the chunk source, d.mu must be held
+func (d *Debugger) lines(source string) map[int]bool {
+	if m, ok := d.matches[source]; ok {
+		return m
+	}
+	var m map[int]bool
+	if strings.HasPrefix(source, "@") {
+		file := cleanPath(source[1:])
+		for path, lines := range d.breakpoints {
+			if !samePath(path, file) {
+				continue
+			}
+			if m == nil {
+				m = make(map[int]bool)
+			}
+			for line := range lines {
+				m[line] = true
+			}
+		}
+	}
+	if d.matches == nil {
+		d.matches = make(map[string]map[int]bool)
+	}
+	d.matches[source] = m
+	return m
+}
+
+// d.mu must be held
+func (d *Debugger) updateArmed() {
+	d.armed.Store(d.session != nil && (len(d.breakpoints) > 0 || d.pause || d.step != stepNone))
+}
+
+func cleanPath(path string) string {
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// reports if the paths are equal or one is a suffix of the other
+func samePath(a, b string) bool {
+	return a == b || strings.HasSuffix(a, "/"+b) || strings.HasSuffix(b, "/"+a)
+}
+
+// returns the number of functions running in the coroutine L
+func stackDepth(L *lua.State) int {
+	n := 0
+	for L.GetStack(n) != nil {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,452 @@
+package debugger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vxcontrol/golua/lua"
+)
+
+// A message of the debugger
+type message struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	Command    string          `json:"command"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// A DAP client driving the debugger in the tests
+type client struct {
+	t      *testing.T
+	nc     net.Conn
+	c      *conn
+	events []message
+}
+
+func dial(t *testing.T, network string, addr net.Addr) *client {
+	nc, err := net.Dial(network, addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return &client{t: t, nc: nc, c: newConn(nc)}
+}
+
+func (c *client) read() message {
+	var m message
+	c.nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := c.c.read(&m); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return m
+}
+
+// sends a request and returns the body of its response, fails if it isn't successful
+func (c *client) request(command string, args interface{}, body interface{}) {
+	c.t.Helper()
+	if m := c.send(command, args); !m.Success {
+		c.t.Fatalf("%s: %s", command, m.Message)
+	} else if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatalf("%s: %v", command, err)
+		}
+	}
+}
+
+// sends a request and returns its response, the events received before are queued
+func (c *client) send(command string, args interface{}) message {
+	c.t.Helper()
+	req := map[string]interface{}{"type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	var seq int
+	if err := c.c.write(func(s int) { seq = s; req["seq"] = s }, req); err != nil {
+		c.t.Fatalf("%s: %v", command, err)
+	}
+	for {
+		m := c.read()
+		if m.Type == "event" {
+			c.events = append(c.events, m)
+			continue
+		}
+		if m.Type != "response" || m.RequestSeq != seq || m.Command != command {
+			c.t.Fatalf("%s: unexpected message %+v", command, m)
+		}
+		return m
+	}
+}
+
+// waits for the event name and decodes its body
+func (c *client) event(name string, body interface{}) {
+	c.t.Helper()
+	var m message
+	if len(c.events) > 0 {
+		m, c.events = c.events[0], c.events[1:]
+	} else {
+		m = c.read()
+	}
+	if m.Type != "event" || m.Event != name {
+		c.t.Fatalf("expected event %s, got %+v", name, m)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+type stoppedBody struct {
+	Reason   string `json:"reason"`
+	ThreadID int    `json:"threadId"`
+}
+
+func (c *client) stopped(reason string) int {
+	c.t.Helper()
+	var b stoppedBody
+	c.event("stopped", &b)
+	if b.Reason != reason {
+		c.t.Fatalf("expected stop on %s, got %s", reason, b.Reason)
+	}
+	return b.ThreadID
+}
+
+func (c *client) stackTrace(threadID int) []stackFrame {
+	c.t.Helper()
+	var b struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	c.request("stackTrace", map[string]int{"threadId": threadID}, &b)
+	if len(b.StackFrames) == 0 {
+		c.t.Fatalf("empty stack of thread %d", threadID)
+	}
+	return b.StackFrames
+}
+
+// returns the variables of a scope of the frame
+func (c *client) scope(frameID int, name string) map[string]variable {
+	c.t.Helper()
+	var b struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", map[string]int{"frameId": frameID}, &b)
+	for _, s := range b.Scopes {
+		if s.Name == name {
+			return c.variables(s.VariablesReference)
+		}
+	}
+	c.t.Fatalf("no scope %s in %+v", name, b.Scopes)
+	return nil
+}
+
+func (c *client) variables(ref int) map[string]variable {
+	c.t.Helper()
+	var b struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", map[string]int{"variablesReference": ref}, &b)
+	vars := make(map[string]variable)
+	for _, v := range b.Variables {
+		vars[v.Name] = v
+	}
+	return vars
+}
+
+func (c *client) initialize() {
+	c.t.Helper()
+	c.request("initialize", map[string]string{"adapterID": "lua"}, nil)
+	c.event("initialized", nil)
+	c.request("attach", nil, nil)
+}
+
+const testScript = `local function add(a, b)
+	local sum = a + b
+	return sum
+end
+local t = {1, 2, name = "x"}
+local r = add(1, 2)
+local co = coroutine.wrap(function(n)
+	local m = n * 2
+	coroutine.yield(m)
+	return m + 1
+end)
+local y = co(5)
+local z = co()
+result = r + y + z
+`
+
+func TestDebugger(t *testing.T) {
+	L := lua.NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	d := Attach(L)
+	defer d.Detach()
+	addr, err := d.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	c := dial(t, "tcp", addr)
+	c.initialize()
+
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "/home/project/scripts/test.lua"},
+		"breakpoints": []map[string]int{{"line": 6}, {"line": 8}},
+	}, &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[1].Line != 8 {
+		t.Fatalf("unexpected breakpoints %+v", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil, nil)
+	select {
+	case <-d.Configured():
+	default:
+		t.Fatal("Configured isn't closed after configurationDone")
+	}
+
+	if err := L.LoadChunk([]byte(testScript), "@scripts/test.lua", "t"); err != nil {
+		t.Fatalf("LoadChunk: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- L.Call(0, 0)
+	}()
+
+	// breakpoint in the main chunk
+	if id := c.stopped("breakpoint"); id != mainThreadID {
+		t.Fatalf("stopped in thread %d", id)
+	}
+	frames := c.stackTrace(mainThreadID)
+	if f := frames[0]; f.Line != 6 || f.Name != "main chunk" || f.Source == nil || f.Source.Path != "scripts/test.lua" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	locals := c.scope(frames[0].ID, "Locals")
+	if v := locals["add"]; v.Type != "function" {
+		t.Fatalf("unexpected local add %+v", v)
+	}
+	tv := locals["t"]
+	if tv.Type != "table" || tv.VariablesReference == 0 {
+		t.Fatalf("unexpected local t %+v", tv)
+	}
+	fields := c.variables(tv.VariablesReference)
+	if fields["[1]"].Value != "1" || fields["[2]"].Value != "2" || fields["name"].Value != `"x"` {
+		t.Fatalf("unexpected fields of t %+v", fields)
+	}
+	var page struct {
+		Variables []variable `json:"variables"`
+	}
+	for _, args := range []map[string]int{{"start": -1}, {"count": -1}, {"start": 10, "count": 10}, {"start": 1, "count": 1}} {
+		args["variablesReference"] = tv.VariablesReference
+		c.request("variables", args, &page)
+		if n := len(page.Variables); (args["start"] == 10 && n != 0) || (args["count"] == 1 && n != 1) || (args["start"] <= 0 && n != 3) {
+			t.Fatalf("unexpected variables %+v for %v", page.Variables, args)
+		}
+	}
+	var threads struct {
+		Threads []thread `json:"threads"`
+	}
+	c.request("threads", nil, &threads)
+	if len(threads.Threads) != 1 {
+		t.Fatalf("unexpected threads %+v", threads.Threads)
+	}
+
+	// step in and out of add
+	c.request("stepIn", map[string]int{"threadId": mainThreadID}, nil)
+	c.stopped("step")
+	frames = c.stackTrace(mainThreadID)
+	if f := frames[0]; f.Line != 2 || f.Name != "add" {
+		t.Fatalf("unexpected frame after stepIn %+v", f)
+	}
+	locals = c.scope(frames[0].ID, "Locals")
+	if locals["a"].Value != "1" || locals["b"].Value != "2" {
+		t.Fatalf("unexpected locals of add %+v", locals)
+	}
+	c.request("next", map[string]int{"threadId": mainThreadID}, nil)
+	c.stopped("step")
+	frames = c.stackTrace(mainThreadID)
+	if f := frames[0]; f.Line != 3 || f.Name != "add" {
+		t.Fatalf("unexpected frame after next %+v", f)
+	}
+	c.request("stepOut", map[string]int{"threadId": mainThreadID}, nil)
+	c.stopped("step")
+	frames = c.stackTrace(mainThreadID)
+	if f := frames[0]; f.Name != "main chunk" || f.Line < 6 {
+		t.Fatalf("unexpected frame after stepOut %+v", f)
+	}
+
+	// breakpoint in the coroutine
+	c.request("continue", map[string]int{"threadId": mainThreadID}, nil)
+	if id := c.stopped("breakpoint"); id != coroutineThreadID {
+		t.Fatalf("stopped in thread %d", id)
+	}
+	c.request("threads", nil, &threads)
+	if len(threads.Threads) != 2 {
+		t.Fatalf("unexpected threads %+v", threads.Threads)
+	}
+	frames = c.stackTrace(coroutineThreadID)
+	if f := frames[0]; f.Line != 8 {
+		t.Fatalf("unexpected frame of the coroutine %+v", f)
+	}
+	if locals = c.scope(frames[0].ID, "Locals"); locals["n"].Value != "5" {
+		t.Fatalf("unexpected locals of the coroutine %+v", locals)
+	}
+	mainFrames := c.stackTrace(mainThreadID)
+	if f := mainFrames[len(mainFrames)-1]; f.Name != "main chunk" || f.Line != 12 {
+		t.Fatalf("unexpected frame of the main coroutine %+v", f)
+	}
+	if locals = c.scope(mainFrames[len(mainFrames)-1].ID, "Locals"); locals["r"].Value != "3" {
+		t.Fatalf("unexpected locals of the main chunk %+v", locals)
+	}
+
+	// stepping over the yield stops in the main coroutine
+	c.request("next", map[string]int{"threadId": coroutineThreadID}, nil)
+	c.stopped("step")
+	c.request("next", map[string]int{"threadId": coroutineThreadID}, nil)
+	if id := c.stopped("step"); id != mainThreadID {
+		t.Fatalf("stopped in thread %d after the yield", id)
+	}
+	frames = c.stackTrace(mainThreadID)
+	if f := frames[0]; f.Name != "main chunk" || f.Line < 12 {
+		t.Fatalf("unexpected frame after the yield %+v", f)
+	}
+
+	// requests of the stop fail once resumed
+	c.request("continue", map[string]int{"threadId": mainThreadID}, nil)
+	if err := <-done; err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if m := c.send("stackTrace", map[string]int{"threadId": mainThreadID}); m.Success {
+		t.Fatal("stackTrace succeeded while running")
+	}
+	L.GetGlobal("result")
+	if n := L.ToNumber(-1); n != 24 {
+		t.Fatalf("unexpected result %v", n)
+	}
+	L.Pop(1)
+}
+
+func TestDebuggerPause(t *testing.T) {
+	L := lua.NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	var stop atomic.Bool
+	L.RegisterFunc("done", func() bool { return stop.Load() })
+
+	d := Attach(L)
+	defer d.Detach()
+	addr, err := d.Listen("unix", filepath.Join(t.TempDir(), "dap.sock"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	c := dial(t, "unix", addr)
+	c.initialize()
+	c.request("configurationDone", nil, nil)
+
+	if err := L.LoadChunk([]byte("local n = 0\nwhile not done() do\n\tn = n + 1\nend\nreturn n\n"), "@loop.lua", "t"); err != nil {
+		t.Fatalf("LoadChunk: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- L.Call(0, 1)
+	}()
+
+	c.request("pause", map[string]int{"threadId": mainThreadID}, nil)
+	c.stopped("pause")
+	frames := c.stackTrace(mainThreadID)
+	if f := frames[0]; f.Source == nil || f.Source.Path != "loop.lua" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	if _, ok := c.scope(frames[0].ID, "Locals")["n"]; !ok {
+		t.Fatal("missing local n")
+	}
+	if v := c.scope(frames[0].ID, "Globals")["done"]; v.Type != "function" {
+		t.Fatalf("unexpected global done %+v", v)
+	}
+
+	// disconnecting resumes the execution
+	stop.Store(true)
+	c.request("disconnect", nil, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the execution isn't resumed after disconnect")
+	}
+	L.Pop(1)
+
+	// a new client may connect
+	c = dial(t, "unix", addr)
+	c.initialize()
+	d.Close()
+	if _, err := net.Dial("unix", addr.String()); err == nil {
+		t.Fatal("the listener is still open after Close")
+	}
+}
+
+func TestDebuggerAfterAbort(t *testing.T) {
+	L := lua.NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	d := Attach(L)
+	defer d.Detach()
+	addr, err := d.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	c := dial(t, "tcp", addr)
+	c.initialize()
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "after.lua"},
+		"breakpoints": []map[string]int{{"line": 2}},
+	}, nil)
+	c.request("configurationDone", nil, nil)
+
+	// a timeout aborts the execution from a hook
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := L.DoStringContext(ctx, `while true do end`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got: %v", err)
+	}
+	L.SetTop(0)
+
+	if err := L.LoadChunk([]byte("local x = 1\nx = x + 1\n"), "@after.lua", "t"); err != nil {
+		t.Fatalf("LoadChunk: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- L.Call(0, 0)
+	}()
+	c.stopped("breakpoint")
+	if f := c.stackTrace(mainThreadID)[0]; f.Line != 2 {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	c.request("continue", map[string]int{"threadId": mainThreadID}, nil)
+	if err := <-done; err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+}
+
+func TestConnContentLength(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go a.Write([]byte("Content-Length: 99999999999\r\n\r\n"))
+	var m message
+	if err := newConn(b).read(&m); err == nil {
+		t.Fatal("a huge content length should be refused")
+	}
+}
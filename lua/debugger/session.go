@@ -0,0 +1,259 @@
+package debugger
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/vxcontrol/golua/lua"
+)
+
+var errNotStopped = errors.New("debugger: the execution isn't stopped")
+
+// The connection of a DAP client
+type session struct {
+	d    *Debugger
+	conn *conn
+}
+
+// Serves the client of rwc until it disconnects
+func (d *Debugger) serveConn(rwc io.ReadWriteCloser) {
+	s := &session{d: d, conn: newConn(rwc)}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		rwc.Close()
+		return
+	}
+	d.session = s
+	d.updateArmed()
+	d.mu.Unlock()
+	defer s.end()
+
+	for {
+		var req request
+		if err := s.conn.read(&req); err != nil {
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !s.handle(&req) {
+			return
+		}
+	}
+}
+
+// Forgets the breakpoints and the stepping of the client and resumes the execution
+func (s *session) end() {
+	d := s.d
+	d.mu.Lock()
+	d.session = nil
+	d.breakpoints = make(map[string]map[int]bool)
+	d.matches = nil
+	d.pause = false
+	// the reference is released by its finalizer, the state may be running
+	d.step, d.stepCo, d.stepCoRef = stepNone, nil, nil
+	d.updateArmed()
+	st := d.stop
+	d.mu.Unlock()
+	if st != nil {
+		st.resume(stepNone)
+	}
+	s.conn.close()
+}
+
+// returns the current stop, nil while running
+func (s *session) stopped() *stop {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return s.d.stop
+}
+
+// Handles a request, returns false when the client disconnects
+func (s *session) handle(req *request) bool {
+	var err error
+	switch req.Command {
+	case "initialize":
+		err = s.conn.respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+		})
+		if err == nil {
+			err = s.conn.event("initialized", nil)
+		}
+	case "launch", "attach", "setExceptionBreakpoints":
+		err = s.conn.respond(req, nil)
+	case "configurationDone":
+		err = s.conn.respond(req, nil)
+		s.d.configuredOnce.Do(func() { close(s.d.configured) })
+	case "setBreakpoints":
+		err = s.setBreakpoints(req)
+	case "threads":
+		threads := []thread{{ID: mainThreadID, Name: "main"}}
+		if st := s.stopped(); st != nil {
+			threads = st.threads()
+		}
+		err = s.conn.respond(req, map[string]interface{}{"threads": threads})
+	case "stackTrace":
+		err = s.stackTrace(req)
+	case "scopes":
+		err = s.scopes(req)
+	case "variables":
+		err = s.variables(req)
+	case "continue":
+		err = s.resume(req, stepNone, map[string]interface{}{"allThreadsContinued": true})
+	case "next":
+		err = s.resume(req, stepOver, nil)
+	case "stepIn":
+		err = s.resume(req, stepIn, nil)
+	case "stepOut":
+		err = s.resume(req, stepOut, nil)
+	case "pause":
+		s.d.mu.Lock()
+		if s.d.stop == nil {
+			s.d.pause = true
+			s.d.updateArmed()
+		}
+		s.d.mu.Unlock()
+		err = s.conn.respond(req, nil)
+	case "disconnect":
+		s.conn.respond(req, nil)
+		return false
+	default:
+		err = s.conn.fail(req, "unsupported request '"+req.Command+"'")
+	}
+	return err == nil
+}
+
+// decodes the arguments of req into v, responds with an error if they are invalid
+func (s *session) arguments(req *request, v interface{}) bool {
+	if len(req.Arguments) == 0 {
+		return true
+	}
+	if err := json.Unmarshal(req.Arguments, v); err != nil {
+		s.conn.fail(req, "invalid arguments: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *session) setBreakpoints(req *request) error {
+	var args setBreakpointsArguments
+	if !s.arguments(req, &args) {
+		return nil
+	}
+	lines := args.Lines
+	if args.Breakpoints != nil {
+		lines = lines[:0]
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+		}
+	}
+	if args.Source.Path == "" {
+		return s.conn.fail(req, "setBreakpoints: missing source path")
+	}
+	s.d.mu.Lock()
+	s.d.setBreakpoints(args.Source.Path, lines)
+	s.d.mu.Unlock()
+
+	bps := make([]breakpoint, len(lines))
+	for i, line := range lines {
+		bps[i] = breakpoint{Verified: true, Line: line, Source: &args.Source}
+	}
+	return s.conn.respond(req, map[string]interface{}{"breakpoints": bps})
+}
+
+func (s *session) stackTrace(req *request) error {
+	var args stackTraceArguments
+	if !s.arguments(req, &args) {
+		return nil
+	}
+	st := s.stopped()
+	if st == nil {
+		return s.conn.fail(req, errNotStopped.Error())
+	}
+	var frames []stackFrame
+	var total int
+	var L *lua.State
+	err := st.run(func() {
+		if L = st.thread(args.ThreadID); L != nil {
+			frames, total = st.stackTrace(L, args.StartFrame, args.Levels)
+		}
+	})
+	switch {
+	case err != nil:
+		return s.conn.fail(req, err.Error())
+	case L == nil:
+		return s.conn.fail(req, "stackTrace: unknown thread")
+	}
+	if frames == nil {
+		frames = []stackFrame{}
+	}
+	return s.conn.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": total})
+}
+
+func (s *session) scopes(req *request) error {
+	var args scopesArguments
+	if !s.arguments(req, &args) {
+		return nil
+	}
+	st := s.stopped()
+	if st == nil {
+		return s.conn.fail(req, errNotStopped.Error())
+	}
+	var scopes []scope
+	var ok bool
+	if err := st.run(func() { scopes, ok = st.scopes(args.FrameID) }); err != nil {
+		return s.conn.fail(req, err.Error())
+	}
+	if !ok {
+		return s.conn.fail(req, "scopes: unknown frame")
+	}
+	return s.conn.respond(req, map[string]interface{}{"scopes": scopes})
+}
+
+func (s *session) variables(req *request) error {
+	var args variablesArguments
+	if !s.arguments(req, &args) {
+		return nil
+	}
+	st := s.stopped()
+	if st == nil {
+		return s.conn.fail(req, errNotStopped.Error())
+	}
+	var vars []variable
+	var ok bool
+	if err := st.run(func() { vars, ok = st.variables(args.VariablesReference) }); err != nil {
+		return s.conn.fail(req, err.Error())
+	}
+	if !ok {
+		return s.conn.fail(req, "variables: unknown reference")
+	}
+	// the client may send any value, a non positive count is all the variables
+	if args.Start < 0 {
+		args.Start = 0
+	} else if args.Start > len(vars) {
+		args.Start = len(vars)
+	}
+	vars = vars[args.Start:]
+	if args.Count > 0 && args.Count < len(vars) {
+		vars = vars[:args.Count]
+	}
+	if vars == nil {
+		vars = []variable{}
+	}
+	return s.conn.respond(req, map[string]interface{}{"variables": vars})
+}
+
+// Responds to req then resumes the execution with the stepping mode
+func (s *session) resume(req *request, mode stepMode, body interface{}) error {
+	st := s.stopped()
+	if st == nil && mode != stepNone {
+		return s.conn.fail(req, errNotStopped.Error())
+	}
+	err := s.conn.respond(req, body)
+	if st != nil {
+		st.resume(mode)
+	}
+	return err
+}
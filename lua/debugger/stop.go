@@ -0,0 +1,345 @@
+package debugger
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vxcontrol/golua/lua"
+)
+
+// Kinds of the variables references
+const (
+	localsHandle = iota
+	upvaluesHandle
+	tableHandle
+)
+
+// A frame of the stack of a coroutine
+type frame struct {
+	L     *lua.State
+	level int
+}
+
+// What a variables reference designates
+type handle struct {
+	kind  int
+	frame frame    // localsHandle and upvaluesHandle
+	ref   *lua.Ref // tableHandle
+}
+
+// A stop of the execution. The state is inspected by the goroutine running
+// it, waiting in the hook: the session passes its requests with run.
+// The frame ids and the variables references are valid until the execution
+// is resumed.
+type stop struct {
+	d *Debugger
+	L *lua.State // the coroutine where the execution stopped
+
+	tasks   chan func()
+	resumed chan stepMode
+	done    chan struct{}
+
+	frames   []frame
+	frameIDs map[frame]int
+	handles  []handle
+}
+
+func newStop(d *Debugger, L *lua.State) *stop {
+	return &stop{
+		d:        d,
+		L:        L,
+		tasks:    make(chan func()),
+		resumed:  make(chan stepMode),
+		done:     make(chan struct{}),
+		frameIDs: make(map[frame]int),
+	}
+}
+
+// Runs the tasks of the session until the execution is resumed, returns the stepping mode
+func (st *stop) wait() stepMode {
+	defer close(st.done)
+	for {
+		select {
+		case f := <-st.tasks:
+			f()
+		case mode := <-st.resumed:
+			return mode
+		}
+	}
+}
+
+// Resumes the execution, false if it has already been resumed
+func (st *stop) resume(mode stepMode) bool {
+	select {
+	case st.resumed <- mode:
+		return true
+	case <-st.done:
+		return false
+	}
+}
+
+// Runs f in the goroutine running the state, returns an error if the
+// execution has been resumed or if f panics
+func (st *stop) run(f func()) (err error) {
+	finished := make(chan struct{})
+	task := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("debugger: %v", r)
+			}
+			close(finished)
+		}()
+		f()
+	}
+	select {
+	case st.tasks <- task:
+		<-finished
+		return err
+	case <-st.done:
+		return errNotStopped
+	}
+}
+
+// Releases the references of the handles
+func (st *stop) release() {
+	for _, h := range st.handles {
+		if h.ref != nil {
+			h.ref.Release()
+		}
+	}
+	st.handles = nil
+}
+
+// returns the coroutine of the thread id, nil if there is no such thread
+func (st *stop) thread(id int) *lua.State {
+	switch {
+	case id == mainThreadID:
+		return st.d.L
+	case id == coroutineThreadID && st.L != st.d.L:
+		return st.L
+	}
+	return nil
+}
+
+func (st *stop) threads() []thread {
+	threads := []thread{{ID: mainThreadID, Name: "main"}}
+	if st.L != st.d.L {
+		threads = append(threads, thread{ID: coroutineThreadID, Name: "coroutine"})
+	}
+	return threads
+}
+
+func (st *stop) frameID(f frame) int {
+	if id, ok := st.frameIDs[f]; ok {
+		return id
+	}
+	st.frames = append(st.frames, f)
+	id := len(st.frames)
+	st.frameIDs[f] = id
+	return id
+}
+
+func (st *stop) addHandle(h handle) int {
+	st.handles = append(st.handles, h)
+	return len(st.handles)
+}
+
+// Returns the frames of the coroutine L from start, at most levels frames
+// if levels is positive, and the total number of frames
+func (st *stop) stackTrace(L *lua.State, start, levels int) ([]stackFrame, int) {
+	var frames []stackFrame
+	for level := 0; ; level++ {
+		ar := L.GetStack(level)
+		if ar == nil {
+			break
+		}
+		L.GetInfo("nSl", ar)
+		frames = append(frames, st.stackFrame(frame{L, level}, ar))
+	}
+	total := len(frames)
+	if start > total {
+		start = total
+	}
+	frames = frames[start:]
+	if levels > 0 && levels < len(frames) {
+		frames = frames[:levels]
+	}
+	return frames, total
+}
+
+func (st *stop) stackFrame(f frame, ar *lua.DebugInfo) stackFrame {
+	sf := stackFrame{ID: st.frameID(f), Name: ar.Name, Line: ar.CurrentLine, Column: 1}
+	switch {
+	case ar.What == "main":
+		sf.Name = "main chunk"
+	case sf.Name == "":
+		sf.Name = "?"
+	}
+	if sf.Line < 0 {
+		sf.Line = 0
+	}
+	switch {
+	case ar.What == "C":
+		sf.Name = "[C] " + sf.Name
+		sf.Column = 0
+		sf.PresentationHint = "subtle"
+	case strings.HasPrefix(ar.Source, "@"):
+		sf.Source = &source{Name: path.Base(cleanPath(ar.Source[1:])), Path: ar.Source[1:]}
+	default:
+		sf.Source = &source{Name: ar.ShortSrc}
+	}
+	return sf
+}
+
+// Returns the scopes of the frame id, false if there is no such frame
+func (st *stop) scopes(id int) ([]scope, bool) {
+	if id < 1 || id > len(st.frames) {
+		return nil, false
+	}
+	f := st.frames[id-1]
+	L := st.L
+	L.PushValue(lua.LUA_GLOBALSINDEX)
+	globals := L.NewRef(-1)
+	L.Pop(1)
+	return []scope{
+		{Name: "Locals", PresentationHint: "locals", VariablesReference: st.addHandle(handle{kind: localsHandle, frame: f})},
+		{Name: "Upvalues", VariablesReference: st.addHandle(handle{kind: upvaluesHandle, frame: f})},
+		{Name: "Globals", VariablesReference: st.addHandle(handle{kind: tableHandle, ref: globals}), Expensive: true},
+	}, true
+}
+
+// Returns the variables of the reference id, false if there is no such reference
+func (st *stop) variables(id int) ([]variable, bool) {
+	if id < 1 || id > len(st.handles) {
+		return nil, false
+	}
+	h := st.handles[id-1]
+	switch h.kind {
+	case localsHandle:
+		return st.locals(h.frame), true
+	case upvaluesHandle:
+		return st.upvalues(h.frame), true
+	default:
+		return st.fields(h.ref), true
+	}
+}
+
+func (st *stop) locals(f frame) []variable {
+	L := f.L
+	ar := L.GetStack(f.level)
+	if ar == nil {
+		return nil
+	}
+	var vars []variable
+	for n := 1; ; n++ {
+		name, ok := L.GetLocal(ar, n)
+		if !ok {
+			break
+		}
+		// internal variables like "(for index)"
+		if !strings.HasPrefix(name, "(") {
+			vars = append(vars, st.variable(L, name))
+		}
+		L.Pop(1)
+	}
+	return vars
+}
+
+func (st *stop) upvalues(f frame) []variable {
+	L := f.L
+	ar := L.GetStack(f.level)
+	if ar == nil {
+		return nil
+	}
+	L.GetInfo("f", ar)
+	defer L.Pop(1)
+	var vars []variable
+	for n := 1; ; n++ {
+		name, ok := L.GetUpvalue(-1, n)
+		if !ok {
+			break
+		}
+		if name == "" {
+			name = "(" + strconv.Itoa(n) + ")"
+		}
+		vars = append(vars, st.variable(L, name))
+		L.Pop(1)
+	}
+	return vars
+}
+
+// returns the fields of a table sorted by key, the numbers first
+func (st *stop) fields(ref *lua.Ref) []variable {
+	type field struct {
+		num   float64
+		isNum bool
+		v     variable
+	}
+	L := st.L
+	ref.PushTo(L)
+	defer L.Pop(1)
+	t := L.GetTop()
+	var fields []field
+	L.PushNil()
+	for L.Next(t) != 0 {
+		var f field
+		switch L.Type(-2) {
+		case lua.LUA_TSTRING:
+			f.v = st.variable(L, L.ToString(-2))
+		case lua.LUA_TNUMBER:
+			f.num, f.isNum = L.ToNumber(-2), true
+			f.v = st.variable(L, "["+formatNumber(f.num)+"]")
+		default:
+			f.v = st.variable(L, "["+valueString(L, -2)+"]")
+		}
+		fields = append(fields, f)
+		L.Pop(1)
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		a, b := fields[i], fields[j]
+		if a.isNum != b.isNum {
+			return a.isNum
+		}
+		if a.isNum {
+			return a.num < b.num
+		}
+		return a.v.Name < b.v.Name
+	})
+	vars := make([]variable, len(fields))
+	for i, f := range fields {
+		vars[i] = f.v
+	}
+	return vars
+}
+
+// Returns the variable name of the value at the top of the stack of L
+func (st *stop) variable(L *lua.State, name string) variable {
+	v := variable{Name: name, Value: valueString(L, -1), Type: L.LTypename(-1)}
+	if L.IsTable(-1) {
+		v.VariablesReference = st.addHandle(handle{kind: tableHandle, ref: L.NewRef(-1)})
+	}
+	return v
+}
+
+// Returns a printable version of the value at index, without calling tostring
+func valueString(L *lua.State, index int) string {
+	switch L.Type(index) {
+	case lua.LUA_TNIL:
+		return "nil"
+	case lua.LUA_TBOOLEAN:
+		return strconv.FormatBool(L.ToBoolean(index))
+	case lua.LUA_TNUMBER:
+		return formatNumber(L.ToNumber(index))
+	case lua.LUA_TSTRING:
+		return strconv.Quote(L.ToString(index))
+	}
+	return fmt.Sprintf("%s: %#x", L.LTypename(index), L.ToPointer(index))
+}
+
+// formats a number like tostring
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
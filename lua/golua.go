@@ -10,6 +10,7 @@ import "C"
 
 import (
 	"reflect"
+	"runtime"
 	"sync"
 	"unsafe"
 
@@ -22,6 +23,9 @@ type Alloc func(ptr unsafe.Pointer, osize uint, nsize uint) unsafe.Pointer
 // This is the type of go function that can be registered as lua functions
 type LuaGoFunction func(L *State) int
 
+// Like LuaGoFunction but returns an error, raised with RaiseGoError when not nil
+type LuaGoFunctionE func(L *State) (int, error)
+
 // This is the type of a go function that can be used as a lua_Hook
 type HookFunction func(L *State)
 
@@ -60,18 +64,68 @@ type State struct {
 	// Upos -> all coroutines within a main state.
 	// For non-main coroutines, AllCoro is a nil map.
 	//
-	// TODO: currently no hooks for garbage collection
-	//  from the Lua side back to Go. So when Lua
-	//  deletes a coroutine, we don't notice, and
-	// it stays in our maps (uniqArray, revUniq, Lmap)
-	// and on the Go side (AllCoro) forever, at the moment.
+	// uniqArray and revUniq don't keep the coroutines
+	// alive, when Lua collects a coroutine a sentinel
+	// userdata (see c-golua.c) removes it from AllCoro.
+	// The coroutines returned by NewThread and ToThread
+	// are anchored in the registry until their Release,
+	// so their wrappers kept in AllCoro stay valid.
 	AllCoro map[int]*State
 
+	// Number of coroutines removed from AllCoro after their collection
+	collectedCoros int
+
+	// Registry reference anchoring the coroutine, 0 when it isn't anchored, see anchorThread
+	anchor int
+
 	// User self defined memory alloc func for the lua State
 	allocfn *Alloc
 
-	// User defined hook function
-	hookFn HookFunction
+	// Results of the go function that suspended this coroutine with YieldWith
+	async *asyncResume
+
+	// Accounting allocator wrapping the allocator of the state, see setMemoryLimit
+	memlimit *C.clua_memlimit
+
+	// Go hooks called by the lua hook, shared by all coroutines (set on the main coroutine)
+	hooks []*luaHook
+
+	// Next id returned by AddHook
+	nextHookID int
+
+	// True when the JIT compiler has been turned off because of a hook
+	jitSuspended bool
+
+	// True when the execution has been aborted by a hook on windows, see callHooks
+	hookAborted bool
+
+	// Error of the hook aborting the execution until the outermost call returns, see callHooks
+	hookErr error
+
+	// True when an outermost call returned an error, see callProtected
+	failed bool
+
+	// True after Close, set with both r and deadRefsMu locked
+	closed bool
+
+	// References of the Refs collected by Go, released by the goroutine using the state
+	deadRefs   []int
+	deadRefsMu sync.Mutex
+
+	// Last error raised by a go function, see callGoFunction
+	goError *LuaError
+
+	// Number of nested calls of callEx
+	callDepth int
+
+	// Error value set by the message handler of callEx when it isn't a string
+	errorValue *Ref
+
+	// Go error of the error raised by a go function, set by the message handler of callEx
+	errorGo error
+
+	// True when the Go errors are raised as user data, see SetGoErrorValues
+	goErrorValues bool
 }
 
 type SharedByAllCoroutines struct {
@@ -80,12 +134,23 @@ type SharedByAllCoroutines struct {
 
 	// Freelist for funcs indices, to allow for freeing
 	freeIndices []uint
+
+	// Errors raised by the assignments to the read-only proxies over
+	// copies of Go values, by registry index (see pushProxyValue)
+	readOnly map[uint]string
+
+	// Go types registered with RegisterType, by type and by metatable name
+	types     map[reflect.Type]*luaType
+	typeNames map[string]*luaType
 }
 
 func newSharedByAllCoroutines() *SharedByAllCoroutines {
 	return &SharedByAllCoroutines{
 		registry:    make([]interface{}, 0, 8),
 		freeIndices: make([]uint, 0, 8),
+		readOnly:    make(map[uint]string),
+		types:       make(map[reflect.Type]*luaType),
+		typeNames:   make(map[string]*luaType),
 	}
 }
 
@@ -155,45 +220,121 @@ func golua_callgofunction(coro *C.lua_State, coroIndex uintptr, mainIndex uintpt
 	}
 
 	if fid < 0 {
-		L1.RaiseError("Requested execution of an unknown function")
-		return 1
+		return L1.callGoFunction(func(L *State) int {
+			L.RaiseError("Requested execution of an unknown function")
+			return 0
+		})
 	}
 	f := L1.Shared.registry[fid].(LuaGoFunction)
 
-	return f(L1)
+	return L1.callGoFunction(f)
+}
+
+// returns the LuaGoFunction raising the error of f with RaiseGoError
+func (f LuaGoFunctionE) luaGoFunction() LuaGoFunction {
+	return func(L *State) int {
+		n, err := f(L)
+		if err != nil {
+			L.RaiseGoError(err)
+		}
+		return n
+	}
+}
+
+// lua_error can't be caught correctly on windows, so there the errors
+// raised by the go functions stay go panics that unwind up to Call
+var raiseWithLuaError = runtime.GOOS != "windows"
+
+// Calls the go function f from lua. When f raises an error (see RaiseError)
+// its message is pushed and -1 is returned, the C side raises it with
+// lua_error so it can be caught by pcall like any lua error.
+func (L *State) callGoFunction(f LuaGoFunction) (n int) {
+	if !raiseWithLuaError {
+		return f(L)
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err, ok := r.(error)
+		if _, abort := r.(hookAbort); abort || !ok {
+			panic(r)
+		}
+		le, ok := err.(*LuaError)
+		if !ok {
+			le = (&LuaError{}).New(L, LUA_ERRRUN, err.Error())
+			le.err = err
+		}
+		// the message handler of Call gets back le with its stack traces
+		L.MainCo.goError = le
+		if le.value != nil {
+			le.value.PushTo(L)
+		} else if le.err != nil && L.MainCo.goErrorValues {
+			L.pushRaisedError(le)
+		} else {
+			L.PushString(le.Msg)
+		}
+		n = -1
+	}()
+	return f(L)
 }
 
 //export golua_callgohook
-func golua_callgohook(coro *C.lua_State, mainIndex uintptr) {
+func golua_callgohook(coro *C.lua_State, mainIndex uintptr, ar *C.lua_Debug) int {
 	L := getGoState(int(mainIndex))
 	L1 := L.ToThreadHelper(coro)
-	if L1.hookFn != nil {
-		L1.hookFn(L1)
-	}
+	return L1.callHooks(ar)
 }
 
 var typeOfBytes = reflect.TypeOf([]byte(nil))
 
 //export golua_interface_newindex_callback
-func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid uint, fieldNameCstr *C.char) int {
+func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid uint) int {
 	L := getGoState(int(mainIndex))
 	L1 := L.ToThreadHelper(coro)
+	if msg, ok := L.Shared.readOnly[iid]; ok {
+		L1.PushString(msg)
+		return -1
+	}
 	iface := L.Shared.registry[iid]
-	ifacevalue := reflect.ValueOf(iface).Elem()
+	return L1.newindexGoObject(iface, 2, 3)
+}
+
+// Assigns the value at vidx to the field (or element) of iface named by the key at kidx.
+// Returns 1 or -1 with an error message on the stack.
+func (L1 *State) newindexGoObject(iface interface{}, kidx int, vidx int) int {
+	ifacevalue := reflect.Indirect(reflect.ValueOf(iface))
+
+	if ifacevalue.Kind() != reflect.Struct {
+		return L1.newindexContainer(ifacevalue, kidx, vidx)
+	}
+	if L1.Type(kidx) != LUA_TSTRING {
+		L1.PushString("Wrong field name type " + L1.LTypename(kidx))
+		return -1
+	}
 
-	fieldName := C.GoString(fieldNameCstr)
+	fieldName := L1.ToString(kidx)
 	fval := ifacevalue.FieldByName(fieldName)
 
-	if fval.Kind() == reflect.Ptr {
+	if !fval.IsValid() {
+		L1.PushString("Unknown field " + fieldName)
+		return -1
+	}
+	if fval.Kind() == reflect.Ptr && !fval.IsNil() {
 		fval = fval.Elem()
 	}
+	if !fval.CanSet() {
+		L1.PushString("Field " + fieldName + " is not assignable")
+		return -1
+	}
 
-	luatype := L1.Type(3)
+	luatype := L1.Type(vidx)
 
 	switch fval.Kind() {
 	case reflect.Bool:
 		if luatype == LUA_TBOOLEAN {
-			fval.SetBool(L1.ToBoolean(3))
+			fval.SetBool(L1.ToBoolean(vidx))
 			return 1
 		} else {
 			L1.PushString("Wrong assignment to field " + fieldName)
@@ -210,7 +351,7 @@ func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid
 		fallthrough
 	case reflect.Int64:
 		if luatype == LUA_TNUMBER {
-			fval.SetInt(L1.ToInteger64(3))
+			fval.SetInt(L1.ToInteger64(vidx))
 			return 1
 		} else {
 			L1.PushString("Wrong assignment to field " + fieldName)
@@ -227,7 +368,7 @@ func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid
 		fallthrough
 	case reflect.Uint64:
 		if luatype == LUA_TNUMBER {
-			fval.SetUint(L1.ToUInteger64(3))
+			fval.SetUint(L1.ToUInteger64(vidx))
 			return 1
 		} else {
 			L1.PushString("Wrong assignment to field " + fieldName)
@@ -236,7 +377,7 @@ func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid
 
 	case reflect.String:
 		if luatype == LUA_TSTRING {
-			fval.SetString(L1.ToString(3))
+			fval.SetString(L1.ToString(vidx))
 			return 1
 		} else {
 			L1.PushString("Wrong assignment to field " + fieldName)
@@ -247,7 +388,7 @@ func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid
 		fallthrough
 	case reflect.Float64:
 		if luatype == LUA_TNUMBER {
-			fval.SetFloat(L1.ToFloat64(3))
+			fval.SetFloat(L1.ToFloat64(vidx))
 			return 1
 		} else {
 			L1.PushString("Wrong assignment to field " + fieldName)
@@ -256,7 +397,7 @@ func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid
 	case reflect.Slice:
 		if fval.Type() == typeOfBytes {
 			if luatype == LUA_TSTRING {
-				fval.SetBytes(L1.ToBytes(3))
+				fval.SetBytes(L1.ToBytes(vidx))
 				return 1
 			} else {
 				L1.PushString("Wrong assignment to field " + fieldName)
@@ -265,72 +406,90 @@ func golua_interface_newindex_callback(coro *C.lua_State, mainIndex uintptr, iid
 		}
 	}
 
-	L1.PushString("Unsupported type of field " + fieldName + ": " + fval.Type().String())
-	return -1
+	// composite fields are assigned from tables or from Go values
+	nval, err := L1.toReflectValue(vidx, fval.Type())
+	if err != nil {
+		L1.PushString("Wrong assignment to field " + fieldName + ": " + err.Error())
+		return -1
+	}
+	fval.Set(nval)
+	return 1
 }
 
 //export golua_interface_index_callback
-func golua_interface_index_callback(coro *C.lua_State, mainIndex uintptr, iid uint, fieldNameCstr *C.char) int {
+func golua_interface_index_callback(coro *C.lua_State, mainIndex uintptr, iid uint) int {
 	L := getGoState(int(mainIndex))
 	L1 := L.ToThreadHelper(coro)
 	iface := L1.Shared.registry[iid]
-	ifacevalue := reflect.ValueOf(iface).Elem()
-
-	fval := ifacevalue.FieldByName(C.GoString(fieldNameCstr))
+	return L1.indexGoObject(iface, 2)
+}
 
-	if fval.Kind() == reflect.Ptr {
-		fval = fval.Elem()
+// returns true when obj is the object iface, the values of the types which
+// aren't comparable (structs holding slices...) are copies compared by type
+func isReceiver(obj, iface interface{}) bool {
+	t := reflect.TypeOf(iface)
+	if reflect.TypeOf(obj) != t {
+		return false
 	}
+	return !t.Comparable() || obj == iface
+}
 
-	switch fval.Kind() {
-	case reflect.Bool:
-		L1.PushBoolean(fval.Bool())
-		return 1
+// Pushes the field, method (or element) of iface named by the key at kidx.
+// Returns the number of pushed values or -1 with an error message on the stack.
+func (L1 *State) indexGoObject(iface interface{}, kidx int) int {
+	ifacevalue := reflect.Indirect(reflect.ValueOf(iface))
 
-	case reflect.Int:
-		fallthrough
-	case reflect.Int8:
-		fallthrough
-	case reflect.Int16:
-		fallthrough
-	case reflect.Int32:
-		fallthrough
-	case reflect.Int64:
-		L1.PushInteger(fval.Int())
+	if ifacevalue.Kind() != reflect.Struct {
+		return L1.indexContainer(ifacevalue, kidx)
+	}
+	if L1.Type(kidx) != LUA_TSTRING {
+		L1.PushNil()
 		return 1
+	}
 
-	case reflect.Uint:
-		fallthrough
-	case reflect.Uint8:
-		fallthrough
-	case reflect.Uint16:
-		fallthrough
-	case reflect.Uint32:
-		fallthrough
-	case reflect.Uint64:
-		L1.PushInteger(int64(fval.Uint()))
-		return 1
+	fieldName := L1.ToString(kidx)
+	fval := ifacevalue.FieldByName(fieldName)
 
-	case reflect.String:
-		L1.PushString(fval.String())
+	if !fval.IsValid() {
+		method := reflect.ValueOf(iface).MethodByName(fieldName)
+		if !method.IsValid() {
+			L1.PushNil()
+			return 1
+		}
+		L1.PushGoClosure(func(L *State) int {
+			// skip the receiver when called as obj:Method(...), not another
+			// object of the same type passed as first argument of obj.Method
+			first := 1
+			if obj, ok := L.toGoObject(1); ok && isReceiver(obj, iface) {
+				first = 2
+			}
+			return L.callReflect(fieldName, method, first)
+		})
 		return 1
+	}
 
-	case reflect.Float32:
-		fallthrough
-	case reflect.Float64:
-		L1.PushNumber(fval.Float())
+	if L1.pushProxyValue(fieldName, fval, L1.proxyReadOnly()) {
 		return 1
-	case reflect.Slice:
-		if fval.Type() == typeOfBytes {
-			L1.PushBytes(fval.Bytes())
-			return 1
-		}
 	}
 
 	L1.PushString("Unsupported type of field: " + fval.Type().String())
 	return -1
 }
 
+//export golua_corogc
+func golua_corogc(mainIndex uintptr, upos int) {
+	L := getGoState(int(mainIndex))
+	if L == nil {
+		return
+	}
+	defer L.r.Unlock()
+	L.r.Lock()
+	if _, ok := L.AllCoro[upos]; ok {
+		delete(L.AllCoro, upos)
+		L.collectedCoros++
+	}
+}
+
 //export golua_gchook
 func golua_gchook(mainIndex uintptr, id uint) int {
 	L := getGoState(int(mainIndex))
@@ -352,11 +511,38 @@ func golua_callallocf(fp uintptr, ptr uintptr, osize uint, nsize uint) uintptr {
 }
 
 //export go_panic_msghandler
-func go_panic_msghandler(coro *C.lua_State, mainIndex uintptr, z *C.char) {
+func go_panic_msghandler(coro *C.lua_State, mainIndex uintptr, z *C.char, fromGo C.int) {
 	L := getGoState(int(mainIndex))
 	L1 := L.ToThreadHelper(coro)
+	main := L1.MainCo
+	// goError is the error being raised only when a go function raises it,
+	// it is stale when lua code caught it and raises another error
+	goError := main.goError
+	main.goError = nil
+	if fromGo == 0 {
+		goError = nil
+	}
+	if z == nil {
+		// not a string, callEx gives the value back with the error
+		le := goError
+		if raised := L1.toRaisedError(-1); raised != nil {
+			le = raised
+		} else if le == nil || le.value == nil {
+			le = (&LuaError{}).New(L1, LUA_ERRRUN, errorValueMessage(L1.LTypename(-1)))
+		}
+		main.errorValue = L1.NewRef(-1).SetFinalizer()
+		L1.Pop(-1)
+		L1.PushString(le.String())
+		return
+	}
 	L1.Pop(-1)
-	L1.PushString((&LuaError{}).New(L1, LUA_ERRRUN, C.GoString(z)).String())
+	msg := C.GoString(z)
+	if le := goError; le != nil && le.Msg == msg {
+		main.errorGo = le.err
+		L1.PushString(le.String())
+		return
+	}
+	L1.PushString((&LuaError{}).New(L1, LUA_ERRRUN, msg).String())
 }
 
 //export go_default_panic_msghandler
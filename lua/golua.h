@@ -12,11 +12,15 @@
 
 typedef struct { int t; void *v; } GoValue;
 
+typedef struct { lua_Alloc f; void *ud; size_t used; size_t limit; int refused; } clua_memlimit;
+
 #define GOLUA_DEFAULT_MSGHANDLER "golua_default_msghandler"
 
 /* function to setup metatables, etc */
 void clua_initstate(lua_State* L);
-void clua_hide_pcall(lua_State *L);
+void clua_alias_pcall(lua_State *L);
+void clua_guard_resume(lua_State *L);
+void clua_markyieldwith(lua_State* L, int on);
 
 lua_State* clua_newstate(void* goallocf);
 int clua_setgostate(lua_State* L, size_t gostateindex);
@@ -27,16 +31,24 @@ int clua_togofunction(lua_State* L, int index);
 int clua_togostruct(lua_State *L, int index);
 
 void clua_pushcallback(lua_State* L);
+void clua_pushtableaccess(lua_State* L, int op);
+void clua_setraisederrorindex(lua_State* L);
 void clua_pushgofunction(lua_State* L, unsigned int fid);
 void clua_pushgostruct(lua_State *L, unsigned int fid);
 
 int dump_chunk (lua_State *L);
 int load_chunk(lua_State *L, char *b, int size, const char* chunk_name);
+int clua_dump(lua_State *L, int index, int strip);
+int clua_loadchunk(lua_State *L, const char *b, size_t size, const char* chunk_name, const char* mode);
 GoValue clua_atpanic(lua_State* L, unsigned int panicf_id);
 int clua_callluacfunc(lua_State* L, lua_CFunction f);
 
 void clua_setallocf(lua_State* L, void* goallocf);
-void clua_sethook(lua_State* L, int n);
+clua_memlimit* clua_setmemlimit(lua_State* L);
+void clua_sethook(lua_State* L, int mask, int count);
+void clua_hookinfo(lua_State* L, lua_Debug *ar);
+int clua_jit_suspend(lua_State* L);
+void clua_jit_resume(lua_State* L);
 
 void clua_openbase(lua_State* L);
 void clua_openio(lua_State* L);
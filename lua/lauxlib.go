@@ -122,12 +122,30 @@ func (L *State) CheckString(narg int) string {
 	return L.ToString(narg)
 }
 
-// luaL_checkoption
+// Like luaL_checkoption returns the index in lst of the string argument narg,
+// or of def when the argument is none or nil. The errors are raised with
+// RaiseError, so unlike luaL_checkoption it works on windows too.
 //
-// BUG(everyone_involved): not implemented
+// An empty def means that the argument is mandatory: "" can't be the default
+// option, even if it is in lst (lua code can still pass it explicitly).
 func (L *State) CheckOption(narg int, def string, lst []string) int {
-	//TODO: complication: lst conversion to const char* lst[] from string slice
-	return 0
+	defer L.r.Unlock()
+	L.r.Lock()
+	name := def
+	if def == "" || !L.IsNoneOrNil(narg) {
+		name = L.CheckString(narg)
+	}
+	for i, opt := range lst {
+		if opt == name {
+			return i
+		}
+	}
+	index := narg
+	if index < 0 {
+		index = L.GetTop() + narg + 1
+	}
+	L.RaiseError(fmt.Sprintf("bad argument #%d (invalid option '%s')", index, name))
+	return -1
 }
 
 // luaL_checktype isn't work on windows due lua_error call
@@ -228,31 +246,88 @@ func (L *State) LoadString(s string) int {
 	return int(C.luaL_loadstring(L.s, Cs))
 }
 
-// lua_dump
+// lua_dump, pushes the chunk of the function at the top of the stack
+// or the error message on failure
 func (L *State) Dump() int {
+	defer L.r.Unlock()
+	L.r.Lock()
 	ret := int(C.dump_chunk(L.s))
 	return ret
 }
 
 // lua_load
 func (L *State) Load(bs []byte, name string) int {
-	chunk := C.CString(string(bs))
 	ckname := C.CString(name)
-	defer C.free(unsafe.Pointer(chunk))
 	defer C.free(unsafe.Pointer(ckname))
-	ret := int(C.load_chunk(L.s, chunk, C.int(len(bs)), ckname))
+	defer L.r.Unlock()
+	L.r.Lock()
+	ret := int(C.load_chunk(L.s, bytesPointer(bs), C.int(len(bs)), ckname))
 	if ret != 0 {
 		return ret
 	}
 	return 0
 }
 
-// lua_newthread
+// Returns the chunk of the function at index, without its debug information
+// (line numbers, names of locals and upvalues) if strip is set.
+// The chunk can be loaded back with LoadChunk.
+func (L *State) DumpFunction(index int, strip bool) ([]byte, error) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	cstrip := C.int(0)
+	if strip {
+		cstrip = 1
+	}
+	if r := int(C.clua_dump(L.s, C.int(index), cstrip)); r != 0 {
+		err := (&LuaError{}).New(L, r, L.ToString(-1))
+		L.Pop(1)
+		return nil, err
+	}
+	b := L.ToBytes(-1)
+	L.Pop(1)
+	return b, nil
+}
+
+// luaL_loadbufferx, loads the chunk b and pushes it as a function.
+// mode is "t" to load text chunks only, "b" to load binary chunks
+// (see DumpFunction) only or "bt" to load both.
+func (L *State) LoadChunk(b []byte, name string, mode string) error {
+	switch mode {
+	case "t", "b", "bt":
+	default:
+		return fmt.Errorf("lua: invalid load mode '%s'", mode)
+	}
+	Cname := C.CString(name)
+	defer C.free(unsafe.Pointer(Cname))
+	Cmode := C.CString(mode)
+	defer C.free(unsafe.Pointer(Cmode))
+	defer L.r.Unlock()
+	L.r.Lock()
+	if r := int(C.clua_loadchunk(L.s, bytesPointer(b), C.size_t(len(b)), Cname, Cmode)); r != 0 {
+		err := (&LuaError{}).New(L, r, L.ToString(-1))
+		L.Pop(1)
+		return err
+	}
+	return nil
+}
+
+// returns the address of the content of b, nil if b is empty
+func bytesPointer(b []byte) *C.char {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.char)(unsafe.Pointer(&b[0]))
+}
+
+// lua_newthread, the new coroutine is pushed and anchored in the registry
+// so the returned State stays valid until its Release (see AllCoro)
 func (L *State) NewThread() *State {
 	defer L.r.Unlock()
 	L.r.Lock()
 	s := C.lua_newthread(L.s)
-	return L.ToThreadHelper(s)
+	L1 := L.ToThreadHelper(s)
+	L.anchorThread(-1, L1)
+	return L1
 }
 
 // Creates a new user data object of specified size and returns it
@@ -278,24 +353,10 @@ func (L *State) NewMetaTable(tname string) bool {
 	return C.luaL_newmetatable(L.s, Ctname) != 0
 }
 
-// luaL_openlibs
+// luaL_openlibs, also loads the bundle with the arguments of the process,
+// see OpenLibsWithOptions
 func (L *State) OpenLibs() {
-	defer L.r.Unlock()
-	L.r.Lock()
-	// stop collector during initialization
-	C.lua_gc(L.s, LUA_GCSTOP, 0)
-	C.luaL_openlibs(L.s)
-	C.lua_gc(L.s, LUA_GCRESTART, -1)
-	C.clua_hide_pcall(L.s)
-	// load bundle loaders
-	C.bundle_add_loaders(L.s)
-	// load bundle main routine and initialize args
-	localArgc := C.int(len(os.Args))
-	localArgv := make([]*C.char, len(os.Args))
-	for i, arg := range os.Args {
-		localArgv[i] = C.CString(arg)
-	}
-	C.bundle_main(L.s, localArgc, &localArgv[0])
+	L.OpenLibsWithOptions(LibOptions{Bundle: true, Args: os.Args})
 }
 
 // luaL_optinteger
@@ -495,18 +556,59 @@ func (L *State) ObjLen(index int) uint {
 	return uint(C.lua_objlen(L.s, C.int(index)))
 }
 
-// lua_yield
+// lua_yield, to be used as `return L.Yield(nresults)` by a go function
+// running in a coroutine. The values passed to the next resume of the
+// coroutine are the results of the go function.
 func (L *State) Yield(nresults int) int {
 	defer L.r.Unlock()
 	L.r.Lock()
+	L.checkYieldable()
 	return int(C.lua_yield(L.s, C.int(nresults)))
 }
 
-// lua_resume
+// raises the error lua_yield would raise with a longjmp over the go function
+func (L *State) checkYieldable() {
+	if L.IsMainCoro {
+		L.RaiseError("attempt to yield from outside a coroutine")
+	}
+	if C.lua_isyieldable(L.s) == 0 {
+		L.RaiseError("attempt to yield across a C-call boundary")
+	}
+}
+
+// lua_resume, L is the coroutine to resume.
+// If the coroutine is suspended by YieldWith, Resume waits for the resume
+// function to be called and passes its results to the coroutine instead of
+// the narg values on the stack. When a result can't be converted by
+// PushGoValue, the coroutine isn't resumed: the error message is pushed and
+// LUA_ERRRUN is returned, the coroutine stays suspended and may be resumed
+// again with the values on the stack.
 func (L *State) Resume(narg int) int {
+	if a := L.async; a != nil {
+		<-a.done
+	}
 	defer L.r.Unlock()
 	L.r.Lock()
-	return int(C.lua_resume(L.s, C.int(narg)))
+	if a := L.async; a != nil {
+		L.async = nil
+		C.clua_markyieldwith(L.s, 0)
+		L.Pop(narg)
+		top := L.GetTop()
+		for i, v := range a.results {
+			if err := L.PushGoValue(v); err != nil {
+				L.SetTop(top)
+				L.PushString(fmt.Sprintf("bad result #%d to the resume function of YieldWith (%v)", i+1, err))
+				return LUA_ERRRUN
+			}
+		}
+		narg = len(a.results)
+	}
+	r := int(C.lua_resume(L.s, C.int(narg)))
+	if r != 0 && r != LUA_YIELD && L.MainCo.callDepth == 0 {
+		// the abort of a hook ends with the resume from Go, see callHooks
+		L.hookAbortError()
+	}
+	return r
 }
 
 // lua_next
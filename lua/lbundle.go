@@ -0,0 +1,195 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Options of OpenLibsWithOptions
+type LibOptions struct {
+	// Adds the bundle loaders to package.loaders and runs the bundle main
+	// routine, the "bundle_loader" module, with Args (see BundledModules)
+	Bundle bool
+
+	// Sets the global arg table like the lua interpreter: arg[0] is Args[0]
+	// and arg[1], arg[2]... are the arguments, no arg table when nil
+	Args []string
+}
+
+// Prefix of the symbols of the lua modules linked in the executable, see libbundle
+const bundleSymbolPrefix = "Blua_"
+
+var (
+	// lua sources added by AddBundledModule
+	bundledSources   = make(map[string][]byte)
+	bundledSourcesMu sync.RWMutex
+
+	// modules found in the symbols of the executable
+	bundledSymbols     []string
+	bundledSymbolsOnce sync.Once
+)
+
+// Opens the standard libraries (luaL_openlibs) and, with opts.Bundle, the bundle:
+// the searchers of the modules of AddBundledModule and of libbundle are
+// appended to package.loaders, then the bundle main routine is run.
+func (L *State) OpenLibsWithOptions(opts LibOptions) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	// stop collector during initialization
+	C.lua_gc(L.s, LUA_GCSTOP, 0)
+	C.luaL_openlibs(L.s)
+	C.lua_gc(L.s, LUA_GCRESTART, -1)
+	C.clua_alias_pcall(L.s)
+	C.clua_guard_resume(L.s)
+	if opts.Args != nil {
+		L.setArgs(opts.Args)
+	}
+	if !opts.Bundle {
+		return
+	}
+
+	// load bundle loaders, the Go sources first
+	L.GetField(LUA_REGISTRYINDEX, "_LOADED")
+	L.GetField(-1, "package")
+	L.GetField(-1, "loaders")
+	L.PushGoClosure(searchBundledSource)
+	L.RawSeti(-2, int(L.ObjLen(-2))+1)
+	L.Pop(3)
+	C.bundle_add_loaders(L.s)
+
+	// load bundle main routine and initialize args
+	argv := make([]*C.char, len(opts.Args)+1)
+	for i, arg := range opts.Args {
+		argv[i] = C.CString(arg)
+		defer C.free(unsafe.Pointer(argv[i]))
+	}
+	C.bundle_main(L.s, C.int(len(opts.Args)), &argv[0])
+}
+
+// sets the global arg table
+func (L *State) setArgs(args []string) {
+	L.CreateTable(len(args), 1)
+	for i, arg := range args {
+		L.PushString(arg)
+		L.RawSeti(-2, i)
+	}
+	L.SetGlobal("arg")
+}
+
+// Adds the lua source (or binary chunk) of the module name to the bundle.
+// It can be required by the states opened with the bundle, its chunk name is "=name".
+// Adding a "bundle_loader" module before opening a state replaces the bundle main routine.
+func AddBundledModule(name string, src []byte) {
+	bundledSourcesMu.Lock()
+	defer bundledSourcesMu.Unlock()
+	bundledSources[name] = src
+}
+
+// Removes the module name added by AddBundledModule, the states already
+// opened with the bundle can't require it anymore either
+func RemoveBundledModule(name string) {
+	bundledSourcesMu.Lock()
+	defer bundledSourcesMu.Unlock()
+	delete(bundledSources, name)
+}
+
+// Returns the sorted names of the modules of the bundle: the modules added by
+// AddBundledModule and the lua modules of libbundle found in the symbols of
+// the executable. The dots of the names of the libbundle modules are replaced
+// by underscores in their symbols, both forms can be required.
+//
+// libbundle doesn't list its modules, so the ones of a stripped executable
+// (go build -ldflags=-s, strip...) aren't returned, they can still be required.
+func BundledModules() []string {
+	bundledSymbolsOnce.Do(func() {
+		bundledSymbols = readBundledSymbols()
+	})
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	bundledSourcesMu.RLock()
+	for name := range bundledSources {
+		add(name)
+	}
+	bundledSourcesMu.RUnlock()
+	for _, name := range bundledSymbols {
+		add(name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// searcher of the sources added by AddBundledModule
+func searchBundledSource(L *State) int {
+	name := L.CheckString(1)
+	bundledSourcesMu.RLock()
+	src, ok := bundledSources[name]
+	bundledSourcesMu.RUnlock()
+	if !ok {
+		L.PushString("\n\tno module '" + name + "' in bundle")
+		return 1
+	}
+	if err := L.LoadChunk(src, "="+name, "bt"); err != nil {
+		L.RaiseError("error loading module '" + name + "' from bundle:\n\t" + err.(*LuaError).Msg)
+	}
+	return 1
+}
+
+// lists the libbundle modules from the symbol table of the executable
+func readBundledSymbols() []string {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	var syms []string
+	if f, err := elf.Open(exe); err == nil {
+		defer f.Close()
+		for _, get := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+			list, _ := get()
+			for _, s := range list {
+				if elf.ST_TYPE(s.Info) == elf.STT_OBJECT {
+					syms = append(syms, s.Name)
+				}
+			}
+		}
+	} else if f, err := macho.Open(exe); err == nil {
+		defer f.Close()
+		if f.Symtab != nil {
+			for _, s := range f.Symtab.Syms {
+				syms = append(syms, strings.TrimPrefix(s.Name, "_"))
+			}
+		}
+	} else if f, err := pe.Open(exe); err == nil {
+		defer f.Close()
+		for _, s := range f.Symbols {
+			syms = append(syms, strings.TrimPrefix(s.Name, "_"))
+		}
+	}
+
+	var names []string
+	for _, s := range syms {
+		if strings.HasPrefix(s, bundleSymbolPrefix) && len(s) > len(bundleSymbolPrefix) {
+			names = append(names, s[len(bundleSymbolPrefix):])
+		}
+	}
+	return names
+}
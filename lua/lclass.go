@@ -0,0 +1,305 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// Go methods named after this table are installed as metamethods by RegisterType
+var luaMetaMethods = map[string]string{
+	"LuaString": "__tostring",
+	"LuaLen":    "__len",
+	"LuaConcat": "__concat",
+	"LuaEq":     "__eq",
+	"LuaLt":     "__lt",
+	"LuaLe":     "__le",
+	"LuaAdd":    "__add",
+	"LuaSub":    "__sub",
+	"LuaMul":    "__mul",
+	"LuaDiv":    "__div",
+	"LuaMod":    "__mod",
+	"LuaPow":    "__pow",
+	"LuaUnm":    "__unm",
+	"LuaCall":   "__call",
+}
+
+// A Go type registered with RegisterType
+type luaType struct {
+	name     string
+	typ      reflect.Type
+	readOnly bool
+	ctors    map[string]interface{}
+}
+
+// Option of RegisterType
+type TypeOption func(lt *luaType)
+
+// Registers fn as a global lua function creating new objects, fn can be
+// any Go function: its arguments are converted from lua and its results
+// of the registered type are pushed as typed user data
+func WithConstructor(name string, fn interface{}) TypeOption {
+	return func(lt *luaType) {
+		lt.ctors[name] = fn
+	}
+}
+
+// Prevents lua code from assigning the fields of the objects
+func ReadOnly() TypeOption {
+	return func(lt *luaType) {
+		lt.readOnly = true
+	}
+}
+
+// Registers the Go type of proto as a lua user data class.
+//
+// A metatable named name is created (luaL_newmetatable) with __index and
+// __newindex giving access to the exported fields and methods, and with
+// metamethods bound to the Go methods following the naming convention
+// LuaString (__tostring), LuaLen, LuaConcat, LuaEq, LuaLt, LuaLe, LuaAdd,
+// LuaSub, LuaMul, LuaDiv, LuaMod, LuaPow, LuaUnm and LuaCall.
+// For binary metamethods the receiver is the operand of the registered type
+// and the method receives the other operand, followed by true when the
+// receiver was the right operand if the method has a second bool parameter:
+// methods of non commutative operators (LuaConcat, LuaSub, LuaDiv, LuaMod,
+// LuaPow, LuaLt, LuaLe) need it to tell "x .. obj" from "obj .. x".
+// Without LuaString a Stringer
+// is used for __tostring, without LuaEq two values are equal when they wrap
+// the same Go object.
+//
+// Values of the registered type are pushed as user data of this class by
+// PushGoValue (and by the automatic conversions built on it) and can be
+// read back with ToValue, ToUserdataOf and CheckUserdataOf.
+func (L *State) RegisterType(name string, proto interface{}, opts ...TypeOption) error {
+	t := reflect.TypeOf(proto)
+	if t == nil {
+		return fmt.Errorf("lua: RegisterType needs a non nil prototype")
+	}
+	if _, ok := L.Shared.types[t]; ok {
+		return fmt.Errorf("lua: type %s is already registered", t)
+	}
+	lt := &luaType{name: name, typ: t, ctors: make(map[string]interface{})}
+	for _, opt := range opts {
+		opt(lt)
+	}
+	for ctor, fn := range lt.ctors {
+		if reflect.ValueOf(fn).Kind() != reflect.Func {
+			return fmt.Errorf("lua: constructor %s of type %s is not a function", ctor, name)
+		}
+	}
+
+	if !L.NewMetaTable(name) {
+		L.Pop(1)
+		return fmt.Errorf("lua: metatable %s already exists", name)
+	}
+	L.PushString(name)
+	L.SetField(-2, "__name")
+
+	L.SetMetaMethod("__index", func(L *State) int {
+		obj := L.checkTypedObject(1, lt)
+		n := L.indexGoObject(obj, 2)
+		if n < 0 {
+			L.RaiseError(L.ToString(-1))
+		}
+		return n
+	})
+	L.SetMetaMethod("__newindex", func(L *State) int {
+		obj := L.checkTypedObject(1, lt)
+		if lt.readOnly {
+			L.RaiseError("attempt to modify read only object of type " + lt.name)
+		}
+		if L.newindexGoObject(obj, 2, 3) < 0 {
+			L.RaiseError(L.ToString(-1))
+		}
+		return 0
+	})
+	L.SetMetaMethod("__gc", func(L *State) int {
+		if id, ok := L.typedObjectID(1); ok {
+			L.unregister(id)
+		}
+		return 0
+	})
+
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if event, ok := luaMetaMethods[m.Name]; ok {
+			L.SetMetaMethod(event, typeMetaMethod(lt, m.Name, event))
+		}
+	}
+	if _, ok := t.MethodByName("LuaString"); !ok {
+		L.SetMetaMethod("__tostring", func(L *State) int {
+			obj := L.checkTypedObject(1, lt)
+			if s, ok := obj.(fmt.Stringer); ok {
+				L.PushString(s.String())
+			} else {
+				L.PushString(fmt.Sprintf("%s: %p", lt.name, obj))
+			}
+			return 1
+		})
+	}
+	if _, ok := t.MethodByName("LuaEq"); !ok {
+		L.SetMetaMethod("__eq", func(L *State) int {
+			a, _ := L.toTypedObject(1, lt)
+			b, _ := L.toTypedObject(2, lt)
+			L.PushBoolean(a != nil && t.Comparable() && a == b)
+			return 1
+		})
+	}
+	L.Pop(1)
+
+	L.Shared.types[t] = lt
+	L.Shared.typeNames[name] = lt
+
+	for ctor, fn := range lt.ctors {
+		ctor, fv := ctor, reflect.ValueOf(fn)
+		L.Register(ctor, func(L *State) int {
+			return L.callReflect(ctor, fv, 1)
+		})
+	}
+	return nil
+}
+
+// builds the metamethod event calling the Go method named method
+func typeMetaMethod(lt *luaType, method string, event string) LuaGoFunction {
+	return func(L *State) int {
+		recv := 1
+		obj, ok := L.toTypedObject(1, lt)
+		if !ok {
+			recv = 2
+			obj = L.checkTypedObject(2, lt)
+		}
+		m := reflect.ValueOf(obj).MethodByName(method)
+
+		switch event {
+		case "__call":
+			return L.callReflect(method, m, 2)
+		case "__unm", "__len", "__tostring":
+			L.SetTop(0)
+		default:
+			// binary operators: pass the other operand, and whether the receiver was on the right
+			L.SetTop(2)
+			L.Remove(recv)
+			if mt := m.Type(); mt.NumIn() == 2 && mt.In(1).Kind() == reflect.Bool {
+				L.PushBoolean(recv == 2)
+			}
+		}
+		return L.callReflect(method, m, 1)
+	}
+}
+
+// pushes v, whose type was registered with RegisterType, as a new user data
+func (L *State) pushTypedObject(lt *luaType, v interface{}) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	id := L.register(v)
+	ud := (*C.uint)(L.NewUserdata(unsafe.Sizeof(C.uint(0))))
+	*ud = C.uint(id)
+	L.LGetMetaTable(lt.name)
+	L.SetMetaTable(-2)
+}
+
+// returns the registry id stored in the user data at index if it is an object of a registered type
+func (L *State) typedObjectID(index int) (uint, bool) {
+	if L.Type(index) != LUA_TUSERDATA || !L.GetMetaTable(index) {
+		return 0, false
+	}
+	L.GetField(-1, "__name")
+	lt := L.Shared.typeNames[L.ToString(-1)]
+	L.Pop(1)
+	if lt == nil {
+		L.Pop(1)
+		return 0, false
+	}
+	L.LGetMetaTable(lt.name)
+	same := L.RawEqual(-1, -2)
+	L.Pop(2)
+	if !same {
+		return 0, false
+	}
+	return uint(*(*C.uint)(L.ToUserdata(index))), true
+}
+
+// returns the Go object of the user data at index if it is of type lt (or of any registered type when lt is nil)
+func (L *State) toTypedObject(index int, lt *luaType) (interface{}, bool) {
+	id, ok := L.typedObjectID(index)
+	if !ok || id >= uint(len(L.Shared.registry)) {
+		return nil, false
+	}
+	obj := L.Shared.registry[id]
+	if lt != nil && reflect.TypeOf(obj) != lt.typ {
+		return nil, false
+	}
+	return obj, obj != nil
+}
+
+// like toTypedObject but raises an argument error on failure
+func (L *State) checkTypedObject(index int, lt *luaType) interface{} {
+	obj, ok := L.toTypedObject(index, lt)
+	if !ok {
+		L.raiseTypeNameError(index, lt.name)
+	}
+	return obj
+}
+
+func (L *State) raiseTypeNameError(narg int, tn string) {
+	vtn := "no value"
+	if !L.IsNone(narg) {
+		vtn = L.LTypename(narg)
+		if id, ok := L.typedObjectID(narg); ok {
+			vtn = L.Shared.types[reflect.TypeOf(L.Shared.registry[id])].name
+		}
+	}
+	L.RaiseError(fmt.Sprintf("bad argument #%d (%s expected, got %s)", narg, tn, vtn))
+}
+
+// returns the Go object wrapped by the user data at index: a struct pushed
+// with PushGoStruct, a go function or an object of a registered type
+func (L *State) toGoObject(index int) (interface{}, bool) {
+	if L.Type(index) != LUA_TUSERDATA {
+		return nil, false
+	}
+	if L.IsGoStruct(index) {
+		obj := L.ToGoStruct(index)
+		return obj, obj != nil
+	}
+	if L.IsGoFunction(index) {
+		f := L.ToGoFunction(index)
+		return f, f != nil
+	}
+	return L.toTypedObject(index, nil)
+}
+
+// Returns the object of type T stored in the user data at index,
+// T must have been registered with RegisterType
+func ToUserdataOf[T any](L *State, index int) (T, bool) {
+	var zero T
+	obj, ok := L.toTypedObject(index, nil)
+	if !ok {
+		return zero, false
+	}
+	v, ok := obj.(T)
+	return v, ok
+}
+
+// Like ToUserdataOf but raises a "bad argument" error when the value at narg
+// isn't an object of type T, in the same way as the other Check functions
+func CheckUserdataOf[T any](L *State, narg int) T {
+	L.CheckStackArg(narg)
+	v, ok := ToUserdataOf[T](L, narg)
+	if !ok {
+		tn := reflect.TypeOf((*T)(nil)).Elem().String()
+		if lt := L.Shared.types[reflect.TypeOf((*T)(nil)).Elem()]; lt != nil {
+			tn = lt.name
+		}
+		L.raiseTypeNameError(narg, tn)
+	}
+	return v
+}
@@ -0,0 +1,75 @@
+package lua
+
+import (
+	"context"
+)
+
+// Number of instructions between two checks of the context in the Context variants
+const contextHookInstructions = 1000
+
+// Error returned by DoStringContext, DoFileContext and CallContext when
+// the context is done before the end of the execution, it wraps ctx.Err()
+// so errors.Is(err, context.DeadlineExceeded) and errors.Is(err, context.Canceled) work
+type ContextError struct {
+	Err error
+}
+
+func (e *ContextError) Error() string {
+	return "lua execution interrupted: " + e.Err.Error()
+}
+
+func (e *ContextError) Unwrap() error {
+	return e.Err
+}
+
+// Like Call but aborts the execution with a *ContextError when ctx is done.
+//
+// A count hook checking ctx is added for the duration of the call, it is
+// chained with the hooks set by SetHook and SetExecutionLimit. Like any
+// error raised by a hook the abort can't be caught by pcall (see
+// SetHookMask), the state can be used again after it.
+func (L *State) CallContext(ctx context.Context, nargs, nresults int) error {
+	if err := ctx.Err(); err != nil {
+		L.Pop(nargs + 1)
+		return &ContextError{err}
+	}
+	done := ctx.Done()
+	if done == nil {
+		return L.Call(nargs, nresults)
+	}
+
+	// the context of an enclosing CallContext is still checked and its hook restored after
+	prev := L.getHook(contextHookID)
+	if prev != nil {
+		defer L.setHook(contextHookID, prev.fn, prev.mask, prev.count)
+	} else {
+		defer L.setHook(contextHookID, nil, 0, 0)
+	}
+	L.setHook(contextHookID, func(l *State, ev HookEvent) {
+		if prev != nil {
+			prev.fn(l, ev)
+		}
+		select {
+		case <-done:
+			panic(&ContextError{ctx.Err()})
+		default:
+		}
+	}, LUA_MASKCOUNT, contextHookInstructions)
+	return L.Call(nargs, nresults)
+}
+
+// Like DoString but aborts the execution with a *ContextError when ctx is done
+func (L *State) DoStringContext(ctx context.Context, str string) error {
+	if r := L.LoadString(str); r != 0 {
+		return (&LuaError{}).New(L, r, L.ToString(-1))
+	}
+	return L.CallContext(ctx, 0, LUA_MULTRET)
+}
+
+// Like DoFile but aborts the execution with a *ContextError when ctx is done
+func (L *State) DoFileContext(ctx context.Context, filename string) error {
+	if r := L.LoadFile(filename); r != 0 {
+		return (&LuaError{}).New(L, r, L.ToString(-1))
+	}
+	return L.CallContext(ctx, 0, LUA_MULTRET)
+}
@@ -0,0 +1,672 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Name of the struct tag used to rename or skip fields when converting
+// Go structs to and from lua tables, e.g. `lua:"name,omitempty"` or `lua:"-"`
+const luaTagName = "lua"
+
+var (
+	typeOfLuaGoFunction = reflect.TypeOf(LuaGoFunction(nil))
+	typeOfEmptyIface    = reflect.TypeOf((*interface{})(nil)).Elem()
+	typeOfError         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// LuaJIT ctype ids of the 64 bit integer cdata, see LuaStackPosToString
+const (
+	ctidInt64  uint32 = 11
+	ctidUint64 uint32 = 12
+)
+
+// visitKey identifies a Go reference value (pointer, map or slice) that is
+// currently being converted, so that cycles can be detected
+type visitKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// Pushes a Go value onto the stack converting it to the matching lua value.
+//
+// Booleans, numbers and strings are pushed as the corresponding lua types,
+// []byte is pushed as a string, LuaGoFunction as a go function, maps,
+// slices, arrays and structs are recursively converted into new tables,
+// *Ref, *Table and *Function push the value they reference.
+// Pointers and interfaces are followed, nil values are pushed as nil.
+// Struct fields may be renamed or skipped with `lua:"name,omitempty"` tags.
+// A reference cycle is pushed as a table containing itself.
+//
+// On error nothing is left on the stack.
+func (L *State) PushGoValue(v interface{}) error {
+	top := L.GetTop()
+	if err := L.pushReflect(reflect.ValueOf(v), make(map[visitKey]int)); err != nil {
+		L.SetTop(top)
+		return err
+	}
+	return nil
+}
+
+// Converts the lua value at index into the Go value pointed by dst.
+//
+// dst must be a non nil pointer. Tables are converted into maps, slices,
+// arrays or structs (by field name or `lua` tag) depending on the type of
+// the destination, into an interface{} destination tables are stored as
+// []interface{} when they are sequences and as map[string]interface{}
+// (or map[interface{}]interface{} for non string keys) otherwise.
+// Numbers are stored as float64 into an interface{} destination.
+// *Ref, *Table and *Function destinations get a reference to the value (see Value).
+// Cyclic tables can't be converted and result in an error.
+//
+// The stack is left unchanged.
+func (L *State) ToValue(index int, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("lua: ToValue needs a non nil pointer, got %T", dst)
+	}
+	top := L.GetTop()
+	defer L.SetTop(top)
+	return L.toReflect(L.absIndex(index), rv.Elem(), make(map[uintptr]bool))
+}
+
+// converts a relative stack index into an absolute one, pseudo indices are left as is
+func (L *State) absIndex(index int) int {
+	if index < 0 && index > LUA_REGISTRYINDEX {
+		return L.GetTop() + index + 1
+	}
+	return index
+}
+
+// parses the lua struct tag of a field, skip is true for unexported fields and `lua:"-"`
+func luaFieldName(f reflect.StructField) (name string, omitempty bool, skip bool) {
+	if f.PkgPath != "" {
+		return "", false, true
+	}
+	tag := f.Tag.Get(luaTagName)
+	if tag == "-" {
+		return "", false, true
+	}
+	name = f.Name
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" {
+		name = parts[0]
+	}
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+	return name, omitempty, false
+}
+
+// pushScalar pushes values of the kinds that map directly onto lua types
+// (booleans, numbers, strings and []byte), it returns false for anything else
+func (L *State) pushScalar(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		L.PushBoolean(v.Bool())
+		return true
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		L.PushInteger(v.Int())
+		return true
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		L.PushInteger(int64(v.Uint()))
+		return true
+
+	case reflect.String:
+		L.PushString(v.String())
+		return true
+
+	case reflect.Float32, reflect.Float64:
+		L.PushNumber(v.Float())
+		return true
+
+	case reflect.Slice:
+		if v.Type() == typeOfBytes {
+			if v.Len() == 0 {
+				L.PushString("")
+			} else {
+				L.PushBytes(v.Bytes())
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (L *State) pushReflect(v reflect.Value, seen map[visitKey]int) error {
+	if !v.IsValid() {
+		L.PushNil()
+		return nil
+	}
+	if lt := L.Shared.types[v.Type()]; lt != nil {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			L.PushNil()
+		} else {
+			L.pushTypedObject(lt, v.Interface())
+		}
+		return nil
+	}
+	if v.Type() == typeOfLuaGoFunction {
+		if v.IsNil() {
+			L.PushNil()
+		} else {
+			L.PushGoFunction(v.Interface().(LuaGoFunction))
+		}
+		return nil
+	}
+	if ok, err := L.pushRefValue(v); ok {
+		return err
+	}
+	if L.pushScalar(v) {
+		return nil
+	}
+	if !L.CheckStack(3) {
+		return fmt.Errorf("lua: stack overflow while converting %s", v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		return L.pushReflect(v.Elem(), seen)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		key := visitKey{ptr: v.Pointer(), typ: v.Type()}
+		if idx, ok := seen[key]; ok {
+			L.PushValue(idx)
+			return nil
+		}
+		seen[key] = L.GetTop() + 1
+		defer delete(seen, key)
+		return L.pushReflect(v.Elem(), seen)
+
+	case reflect.Map:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		key := visitKey{ptr: v.Pointer(), typ: v.Type()}
+		if idx, ok := seen[key]; ok {
+			L.PushValue(idx)
+			return nil
+		}
+		L.CreateTable(0, v.Len())
+		seen[key] = L.GetTop()
+		defer delete(seen, key)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := L.pushReflect(iter.Key(), seen); err != nil {
+				return err
+			}
+			if L.IsNil(-1) {
+				return fmt.Errorf("lua: nil map key in %s", v.Type())
+			}
+			if n := L.ToNumber(-1); L.Type(-1) == LUA_TNUMBER && n != n {
+				return fmt.Errorf("lua: NaN map key in %s", v.Type())
+			}
+			if err := L.pushReflect(iter.Value(), seen); err != nil {
+				return err
+			}
+			L.RawSet(-3)
+		}
+		return nil
+
+	case reflect.Slice:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		key := visitKey{ptr: v.Pointer(), typ: v.Type(), len: v.Len()}
+		if idx, ok := seen[key]; ok {
+			L.PushValue(idx)
+			return nil
+		}
+		L.CreateTable(v.Len(), 0)
+		seen[key] = L.GetTop()
+		defer delete(seen, key)
+		return L.pushElements(v, seen)
+
+	case reflect.Array:
+		L.CreateTable(v.Len(), 0)
+		return L.pushElements(v, seen)
+
+	case reflect.Struct:
+		t := v.Type()
+		L.CreateTable(0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name, omitempty, skip := luaFieldName(t.Field(i))
+			fv := v.Field(i)
+			if skip || (omitempty && fv.IsZero()) {
+				continue
+			}
+			if err := L.pushReflect(fv, seen); err != nil {
+				return err
+			}
+			L.SetField(-2, name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("lua: unsupported Go type %s", v.Type())
+}
+
+// stores the elements of a slice or array into the table at the top of the stack
+func (L *State) pushElements(v reflect.Value, seen map[visitKey]int) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := L.pushReflect(v.Index(i), seen); err != nil {
+			return err
+		}
+		L.RawSeti(-2, i+1)
+	}
+	return nil
+}
+
+// tonumber returns the lua number or 64 bit cdata at index as a float64
+func (L *State) tonumber(index int) (float64, bool) {
+	switch t := L.Type(index); {
+	case t == LUA_TNUMBER:
+		return L.ToNumber(index), true
+	case t == LUA_TCDATA:
+		switch L.LuaJITctypeID(index) {
+		case ctidInt64:
+			return float64(L.CdataToInt64(index)), true
+		case ctidUint64:
+			return float64(L.CdataToUint64(index)), true
+		}
+	}
+	return 0, false
+}
+
+func (L *State) typeError(index int, t reflect.Type) error {
+	return fmt.Errorf("lua: cannot convert lua %s to Go %s", L.LTypename(index), t)
+}
+
+// toReflect converts the value at the absolute index into v, path holds the tables being converted
+func (L *State) toReflect(index int, v reflect.Value, path map[uintptr]bool) error {
+	t := L.Type(index)
+	if t == LUA_TNIL || t == LUA_TNONE {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	// objects that are already Go values
+	if t == LUA_TUSERDATA {
+		if obj, ok := L.toGoObject(index); ok {
+			ov := reflect.ValueOf(obj)
+			switch {
+			case ov.Type().AssignableTo(v.Type()):
+				v.Set(ov)
+				return nil
+			case ov.Kind() == reflect.Ptr && ov.Elem().Type().AssignableTo(v.Type()):
+				v.Set(ov.Elem())
+				return nil
+			}
+		}
+	}
+
+	// references to the lua value
+	switch {
+	case v.Type() == typeOfRef:
+		v.Set(reflect.ValueOf(L.NewRef(index).SetFinalizer()))
+		return nil
+	case v.Type() == typeOfTable && t != LUA_TTABLE, v.Type() == typeOfFunction && t != LUA_TFUNCTION:
+		return L.typeError(index, v.Type())
+	case v.Type() == typeOfTable, v.Type() == typeOfFunction:
+		v.Set(reflect.ValueOf(L.toLuaValue(index)))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		x, err := L.toInterface(index, path)
+		if err != nil {
+			return err
+		}
+		xv := reflect.ValueOf(x)
+		if !xv.Type().AssignableTo(v.Type()) {
+			return L.typeError(index, v.Type())
+		}
+		v.Set(xv)
+		return nil
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return L.toReflect(index, v.Elem(), path)
+
+	case reflect.Bool:
+		if t != LUA_TBOOLEAN {
+			return L.typeError(index, v.Type())
+		}
+		v.SetBool(L.ToBoolean(index))
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if t == LUA_TCDATA && L.LuaJITctypeID(index) == ctidInt64 {
+			n := L.CdataToInt64(index)
+			if v.OverflowInt(n) {
+				return fmt.Errorf("lua: number %d overflows Go %s", n, v.Type())
+			}
+			v.SetInt(n)
+			return nil
+		}
+		n, ok := L.tonumber(index)
+		if !ok {
+			return L.typeError(index, v.Type())
+		}
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 || v.OverflowInt(int64(n)) {
+			return fmt.Errorf("lua: number %v can't be represented as Go %s", n, v.Type())
+		}
+		v.SetInt(int64(n))
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if t == LUA_TCDATA && L.LuaJITctypeID(index) == ctidUint64 {
+			n := L.CdataToUint64(index)
+			if v.OverflowUint(n) {
+				return fmt.Errorf("lua: number %d overflows Go %s", n, v.Type())
+			}
+			v.SetUint(n)
+			return nil
+		}
+		n, ok := L.tonumber(index)
+		if !ok {
+			return L.typeError(index, v.Type())
+		}
+		if n != math.Trunc(n) || n < 0 || n >= math.MaxUint64 || v.OverflowUint(uint64(n)) {
+			return fmt.Errorf("lua: number %v can't be represented as Go %s", n, v.Type())
+		}
+		v.SetUint(uint64(n))
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		n, ok := L.tonumber(index)
+		if !ok {
+			return L.typeError(index, v.Type())
+		}
+		v.SetFloat(n)
+		return nil
+
+	case reflect.String:
+		if t != LUA_TSTRING {
+			return L.typeError(index, v.Type())
+		}
+		v.SetString(L.ToString(index))
+		return nil
+
+	case reflect.Slice:
+		if v.Type() == typeOfBytes && t == LUA_TSTRING {
+			v.SetBytes(L.ToBytes(index))
+			return nil
+		}
+		if t != LUA_TTABLE {
+			return L.typeError(index, v.Type())
+		}
+		return L.withTable(index, path, func() error {
+			n := int(L.ObjLen(index))
+			s := reflect.MakeSlice(v.Type(), n, n)
+			if err := L.toElements(index, s, path); err != nil {
+				return err
+			}
+			v.Set(s)
+			return nil
+		})
+
+	case reflect.Array:
+		if t != LUA_TTABLE {
+			return L.typeError(index, v.Type())
+		}
+		return L.withTable(index, path, func() error {
+			return L.toElements(index, v, path)
+		})
+
+	case reflect.Map:
+		if t != LUA_TTABLE {
+			return L.typeError(index, v.Type())
+		}
+		return L.withTable(index, path, func() error {
+			m := reflect.MakeMap(v.Type())
+			kt, et := v.Type().Key(), v.Type().Elem()
+			L.PushNil()
+			for L.Next(index) != 0 {
+				top := L.GetTop()
+				k := reflect.New(kt).Elem()
+				if err := L.toReflect(top-1, k, path); err != nil {
+					return err
+				}
+				e := reflect.New(et).Elem()
+				if err := L.toReflect(top, e, path); err != nil {
+					return err
+				}
+				m.SetMapIndex(k, e)
+				L.Pop(1)
+			}
+			v.Set(m)
+			return nil
+		})
+
+	case reflect.Struct:
+		if t != LUA_TTABLE {
+			return L.typeError(index, v.Type())
+		}
+		return L.withTable(index, path, func() error {
+			st := v.Type()
+			for i := 0; i < st.NumField(); i++ {
+				name, _, skip := luaFieldName(st.Field(i))
+				if skip {
+					continue
+				}
+				L.GetField(index, name)
+				err := L.toReflect(L.GetTop(), v.Field(i), path)
+				L.Pop(1)
+				if err != nil {
+					return fmt.Errorf("%w (field %s)", err, st.Field(i).Name)
+				}
+			}
+			return nil
+		})
+	}
+
+	return L.typeError(index, v.Type())
+}
+
+// converts the value at index into a new Go value of type t, the stack is left unchanged
+func (L *State) toReflectValue(index int, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	top := L.GetTop()
+	err := L.toReflect(L.absIndex(index), v, make(map[uintptr]bool))
+	L.SetTop(top)
+	return v, err
+}
+
+// withTable runs f while the table at index is marked as being converted
+func (L *State) withTable(index int, path map[uintptr]bool, f func() error) error {
+	p := L.ToPointer(index)
+	if path[p] {
+		return fmt.Errorf("lua: cycle detected while converting table 0x%x", p)
+	}
+	if !L.CheckStack(3) {
+		return fmt.Errorf("lua: stack overflow while converting table 0x%x", p)
+	}
+	path[p] = true
+	defer delete(path, p)
+	return f()
+}
+
+// fills the slice or array v with t[1], t[2], ... of the table at index
+func (L *State) toElements(index int, v reflect.Value, path map[uintptr]bool) error {
+	for i := 0; i < v.Len(); i++ {
+		L.RawGeti(index, i+1)
+		err := L.toReflect(L.GetTop(), v.Index(i), path)
+		L.Pop(1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toInterface converts the value at the absolute index into its natural Go representation
+func (L *State) toInterface(index int, path map[uintptr]bool) (interface{}, error) {
+	switch t := L.Type(index); t {
+	case LUA_TNIL, LUA_TNONE:
+		return nil, nil
+	case LUA_TBOOLEAN:
+		return L.ToBoolean(index), nil
+	case LUA_TNUMBER:
+		return L.ToNumber(index), nil
+	case LUA_TSTRING:
+		return L.ToString(index), nil
+	case LUA_TCDATA:
+		switch L.LuaJITctypeID(index) {
+		case ctidInt64:
+			return L.CdataToInt64(index), nil
+		case ctidUint64:
+			return L.CdataToUint64(index), nil
+		}
+	case LUA_TUSERDATA:
+		if obj, ok := L.toGoObject(index); ok {
+			return obj, nil
+		}
+	case LUA_TTABLE:
+		var res interface{}
+		err := L.withTable(index, path, func() (err error) {
+			res, err = L.tableToInterface(index, path)
+			return err
+		})
+		return res, err
+	}
+	return nil, L.typeError(index, typeOfEmptyIface)
+}
+
+func (L *State) tableToInterface(index int, path map[uintptr]bool) (interface{}, error) {
+	// first pass: find out what kind of keys the table has
+	count, allInts, allStrings := 0, true, true
+	n := int(L.ObjLen(index))
+	L.PushNil()
+	for L.Next(index) != 0 {
+		count++
+		switch L.Type(-2) {
+		case LUA_TNUMBER:
+			k := L.ToNumber(-2)
+			if k != math.Trunc(k) || k < 1 || k > float64(n) {
+				allInts = false
+			}
+			allStrings = false
+		case LUA_TSTRING:
+			allInts = false
+		default:
+			allInts, allStrings = false, false
+		}
+		L.Pop(1)
+	}
+
+	if count > 0 && allInts && count == n {
+		s := make([]interface{}, n)
+		return s, L.toElements(index, reflect.ValueOf(s), path)
+	}
+
+	var m reflect.Value
+	if allStrings {
+		m = reflect.ValueOf(make(map[string]interface{}, count))
+	} else {
+		m = reflect.ValueOf(make(map[interface{}]interface{}, count))
+	}
+	kt := m.Type().Key()
+	L.PushNil()
+	for L.Next(index) != 0 {
+		top := L.GetTop()
+		k := reflect.New(kt).Elem()
+		if err := L.toReflect(top-1, k, path); err != nil {
+			return nil, err
+		}
+		if k.Kind() == reflect.Interface && !k.Elem().Type().Comparable() {
+			return nil, fmt.Errorf("lua: table key of type %s can't be used as a Go map key", L.LTypename(top-1))
+		}
+		e := reflect.New(typeOfEmptyIface).Elem()
+		if err := L.toReflect(top, e, path); err != nil {
+			return nil, err
+		}
+		m.SetMapIndex(k, e)
+		L.Pop(1)
+	}
+	return m.Interface(), nil
+}
+
+// callReflect calls fn with the lua arguments starting at the stack index
+// first converted to its parameter types, then pushes its results and
+// returns their number. A non nil trailing error result is raised as a lua
+// error, as are arguments that can't be converted.
+func (L *State) callReflect(name string, fn reflect.Value, first int) int {
+	ft := fn.Type()
+	nin := ft.NumIn()
+	fixed := nin
+	if ft.IsVariadic() {
+		fixed--
+	}
+	nargs := L.GetTop() - first + 1
+	if nargs < fixed {
+		nargs = fixed
+	}
+	if !ft.IsVariadic() {
+		nargs = fixed
+	}
+
+	args := make([]reflect.Value, nargs)
+	for i := range args {
+		var at reflect.Type
+		if i < fixed {
+			at = ft.In(i)
+		} else {
+			at = ft.In(fixed).Elem()
+		}
+		args[i] = L.checkReflectArg(name, first+i, i+1, at)
+	}
+
+	out := fn.Call(args)
+	if n := len(out); n > 0 && ft.Out(n-1) == typeOfError {
+		if err := out[n-1]; !err.IsNil() {
+			L.RaiseGoError(err.Interface().(error))
+		}
+		out = out[:n-1]
+	}
+	for i, res := range out {
+		if err := L.pushReflect(res, make(map[visitKey]int)); err != nil {
+			L.RaiseError(fmt.Sprintf("bad result #%d from '%s' (%s)", i+1, name, err.Error()))
+		}
+	}
+	return len(out)
+}
+
+// checkReflectArg converts the argument at index into a value of type t,
+// raising a "bad argument" error in the style of raiseArgumentError on failure
+func (L *State) checkReflectArg(name string, index int, narg int, t reflect.Type) reflect.Value {
+	if L.IsNoneOrNil(index) {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func:
+			return reflect.New(t).Elem()
+		}
+	} else if v, err := L.toReflectValue(index, t); err == nil {
+		return v
+	}
+	vtn := "no value"
+	if !L.IsNone(index) {
+		vtn = L.LTypename(index)
+	}
+	L.RaiseError(fmt.Sprintf("bad argument #%d to '%s' (%s expected, got %s)", narg, name, t, vtn))
+	return reflect.Value{}
+}
@@ -0,0 +1,65 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"sync"
+)
+
+// Results passed to the resume function of YieldWith
+type asyncResume struct {
+	once    sync.Once
+	done    chan struct{}
+	results []interface{}
+}
+
+func (a *asyncResume) resume(results ...interface{}) {
+	a.once.Do(func() {
+		a.results = results
+		close(a.done)
+	})
+}
+
+// Suspends the coroutine running a go function until an asynchronous
+// operation is done, to be used as `return L.YieldWith(f)`.
+//
+// f is called before the coroutine is suspended, it must start the operation
+// and return. resume can then be called once, from any goroutine, with the
+// results of the go function: they are converted with PushGoValue.
+// The coroutine must be resumed from go with Resume, which waits for the
+// call to resume if needed, Resumable tells when it won't wait. Until then
+// it can't be resumed from lua: coroutine.resume returns false with an error
+// and the functions of coroutine.wrap raise it.
+func (L *State) YieldWith(f func(resume func(results ...interface{}))) int {
+	L.checkYieldable()
+	a := &asyncResume{done: make(chan struct{})}
+	f(a.resume)
+	L.async = a
+	C.clua_markyieldwith(L.s, 1)
+	return L.Yield(0)
+}
+
+// Returns a channel closed when the coroutine L can be resumed
+// without waiting for the resume function of YieldWith
+func (L *State) Resumable() <-chan struct{} {
+	if a := L.async; a != nil {
+		return a.done
+	}
+	closed := make(chan struct{})
+	close(closed)
+	return closed
+}
+
+// Returns the number of coroutines known by go (see AllCoro) that have
+// been released after their collection by lua
+func (L *State) CollectedCoroutines() int {
+	defer L.r.Unlock()
+	L.r.Lock()
+	return L.MainCo.collectedCoros
+}
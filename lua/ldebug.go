@@ -0,0 +1,151 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// Activation record of a function (lua_Debug), filled by GetStack and GetInfo.
+// The fields are set by GetInfo depending on its what option.
+type DebugInfo struct {
+	Event           int    // event of the hook, see HookEvent
+	Name            string // (n) name of the function, if any
+	NameWhat        string // (n) "global", "local", "method", "field", "upvalue" or ""
+	What            string // (S) "Lua", "C", "main" or "tail"
+	Source          string // (S) source of the chunk of the function
+	ShortSrc        string // (S) printable version of Source
+	CurrentLine     int    // (l) current line of the function, -1 if not available
+	NUps            int    // (u) number of upvalues of the function
+	LineDefined     int    // (S) line where the definition of the function starts
+	LastLineDefined int    // (S) line where the definition of the function ends
+
+	// the activation record of GetStack, only valid while the function is running
+	ar    C.lua_Debug
+	stack bool
+}
+
+// lua_getstack, returns the activation record of the function running at
+// level (0 is the current function), nil if level is greater than the stack depth.
+// The record can be used with GetInfo, GetLocal and SetLocal while the function runs.
+func (L *State) GetStack(level int) *DebugInfo {
+	defer L.r.Unlock()
+	L.r.Lock()
+	ar := &DebugInfo{stack: true}
+	if C.lua_getstack(L.s, C.int(level), &ar.ar) == 0 {
+		return nil
+	}
+	return ar
+}
+
+// lua_getinfo, fills ar with the information selected by what: "n" for Name
+// and NameWhat, "S" for What, Source, ShortSrc, LineDefined and
+// LastLineDefined, "l" for CurrentLine and "u" for NUps. "f" pushes the
+// running function and "L" the table of its valid lines.
+// With a '>' prefix the information is about the function popped from the
+// top of the stack instead of the function of ar (see GetInfoForFunction).
+// Returns false for an invalid what, and without the prefix for an ar which
+// hasn't been returned by GetStack.
+func (L *State) GetInfo(what string, ar *DebugInfo) bool {
+	if !ar.stack && !strings.HasPrefix(what, ">") {
+		return false
+	}
+	Cwhat := C.CString(what)
+	defer C.free(unsafe.Pointer(Cwhat))
+	defer L.r.Unlock()
+	L.r.Lock()
+	if C.lua_getinfo(L.s, Cwhat, &ar.ar) == 0 {
+		return false
+	}
+	d := &ar.ar
+	ar.Event = int(d.event)
+	ar.Name = C.GoString(d.name)
+	ar.NameWhat = C.GoString(d.namewhat)
+	ar.What = C.GoString(d.what)
+	ar.Source = C.GoString(d.source)
+	ar.ShortSrc = C.GoString(&d.short_src[0])
+	ar.CurrentLine = int(d.currentline)
+	ar.NUps = int(d.nups)
+	ar.LineDefined = int(d.linedefined)
+	ar.LastLineDefined = int(d.lastlinedefined)
+	return true
+}
+
+// Returns the information "nSlu" (see GetInfo) about the function at index,
+// nil if the value isn't a function
+func (L *State) GetInfoForFunction(index int) *DebugInfo {
+	if !L.IsFunction(index) {
+		return nil
+	}
+	ar := &DebugInfo{}
+	L.PushValue(index)
+	L.GetInfo(">nSlu", ar)
+	return ar
+}
+
+// lua_getlocal, pushes the value of the local variable n (1 is the first
+// parameter) of the function of ar, returned by GetStack, and returns its
+// name. Names starting with '(' are internal variables. Returns false and
+// pushes nothing if there is no local n.
+func (L *State) GetLocal(ar *DebugInfo, n int) (string, bool) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	if !ar.stack {
+		return "", false
+	}
+	name := C.lua_getlocal(L.s, &ar.ar, C.int(n))
+	if name == nil {
+		return "", false
+	}
+	return C.GoString(name), true
+}
+
+// lua_setlocal, pops a value and assigns it to the local variable n of the
+// function of ar, returns its name. Returns false (the value is still
+// popped) if there is no local n.
+func (L *State) SetLocal(ar *DebugInfo, n int) (string, bool) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	if !ar.stack {
+		L.Pop(1)
+		return "", false
+	}
+	name := C.lua_setlocal(L.s, &ar.ar, C.int(n))
+	if name == nil {
+		return "", false
+	}
+	return C.GoString(name), true
+}
+
+// lua_getupvalue, pushes the value of the upvalue n of the function at
+// funcindex and returns its name ("" for the upvalues of C functions).
+// Returns false and pushes nothing if there is no upvalue n.
+func (L *State) GetUpvalue(funcindex, n int) (string, bool) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	name := C.lua_getupvalue(L.s, C.int(funcindex), C.int(n))
+	if name == nil {
+		return "", false
+	}
+	return C.GoString(name), true
+}
+
+// lua_setupvalue, pops a value and assigns it to the upvalue n of the
+// function at funcindex, returns its name. Returns false (the value isn't
+// popped) if there is no upvalue n.
+func (L *State) SetUpvalue(funcindex, n int) (string, bool) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	name := C.lua_setupvalue(L.s, C.int(funcindex), C.int(n))
+	if name == nil {
+		return "", false
+	}
+	return C.GoString(name), true
+}
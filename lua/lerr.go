@@ -39,8 +39,20 @@ type LuaError struct {
 	LuaS  []string        `json:"lua_stack"`
 	LuaST []LuaStackEntry `json:"lua_stacktrace"`
 	GoST  []GoStackEntry  `json:"go_stacktrace"`
+
+	// Go error raised by a go function, see RaiseGoError
+	err error
+
+	// Error value when it isn't a string, see RaiseErrorValue
+	value *Ref
+
+	// True when an allocation has been refused by the memory limit, see SetMemoryLimit
+	memoryLimitHit bool
 }
 
+// Name of the metatable of the Go errors raised into lua, see pushRaisedError
+const raisedErrorMetaTable = "GoLua.RaisedError"
+
 func (le *LuaError) Error() string {
 	buffer := bytes.Buffer{}
 	buffer.WriteString(fmt.Sprintf("lua error code: %d; %s\n", le.Code, le.Msg))
@@ -71,6 +83,34 @@ func (le *LuaError) Error() string {
 	return buffer.String()
 }
 
+// Returns the Go error raised with RaiseGoError (or returned by a LuaGoFunctionE),
+// nil for the errors raised by lua
+func (le *LuaError) Unwrap() error {
+	return le.err
+}
+
+// Returns the error value (see Value): the value given to error() or to
+// RaiseErrorValue, Msg when the error value is a string
+func (le *LuaError) Value() Value {
+	if le.value == nil {
+		return le.Msg
+	}
+	r := le.value
+	defer r.L.r.Unlock()
+	r.L.r.Lock()
+	if r.released() {
+		return nil
+	}
+	r.Push()
+	defer r.L.Pop(1)
+	return r.L.toLuaValue(-1)
+}
+
+// Returns a reference to the error value, nil when the error value is a string
+func (le *LuaError) Ref() *Ref {
+	return le.value
+}
+
 func (le *LuaError) Parse(data string) error {
 	err := json.Unmarshal([]byte(data), le)
 	if err != nil {
@@ -101,23 +141,28 @@ func (le *LuaError) New(state *State, code int, msg string) *LuaError {
 	return le
 }
 
-// Sets the lua hook (lua_sethook).
-// This and SetExecutionLimit are mutual exclusive
+// Sets the lua hook (lua_sethook) called every instrNumber instructions,
+// a nil f or a non positive instrNumber removes the hook.
+// This is SetHookMask for the count event only, see it for the chaining with SetExecutionLimit.
+//
+// Hooks aren't called by JIT compiled code, so the JIT compiler
+// is turned off while a hook is set and turned on again after.
 func (L *State) SetHook(f HookFunction, instrNumber int) {
-	defer L.r.Unlock()
-	L.r.Lock()
-	L.hookFn = f
-	C.clua_sethook(L.s, C.int(instrNumber))
+	if f == nil {
+		L.SetHookMask(nil, 0, 0)
+		return
+	}
+	L.SetHookMask(func(L *State, ev HookEvent) {
+		f(L)
+	}, LUA_MASKCOUNT, instrNumber)
 }
 
 // Sets the maximum number of operations to execute at instrNumber, after this the execution ends
-// This and SetHook are mutual exclusive
+// This is chained with the hook set by SetHook and SetHookMask, a non positive instrNumber removes the limit
 func (L *State) SetExecutionLimit(instrNumber int) {
-	defer L.r.Unlock()
-	L.r.Lock()
-	L.SetHook(func(l *State) {
+	L.setHook(limitHookID, func(l *State, ev HookEvent) {
 		l.RaiseError(ExecutionQuantumExceeded)
-	}, instrNumber)
+	}, LUA_MASKCOUNT, instrNumber)
 }
 
 // correctly catching lua_error can't support on windows so there using go panic method
@@ -128,6 +173,109 @@ func (L *State) RaiseError(msg string) {
 	// C.lua_error(L.s)
 }
 
+// Like RaiseError but keeps err: the *LuaError returned by Call (or DoString...)
+// unwraps to err, so errors.Is and errors.As can find it. The error value seen
+// by lua is the message of err, so an error caught and raised again by lua code
+// is a lua error, unless the state raises the Go errors as values (see
+// SetGoErrorValues).
+func (L *State) RaiseGoError(err error) {
+	le := (&LuaError{}).New(L, LUA_ERRRUN, err.Error())
+	le.err = err
+	L.PushString(le.String())
+	panic(le)
+}
+
+// Raises v, converted with PushGoValue, as the error value. Unlike with
+// RaiseError the lua code catching the error gets v (a table for a map or
+// a struct...) and the *LuaError returned by Call gives it back with Value.
+func (L *State) RaiseErrorValue(v interface{}) {
+	if err := L.PushGoValue(v); err != nil {
+		L.RaiseError(err.Error())
+	}
+	le := (&LuaError{}).New(L, LUA_ERRRUN, errorValueMessage(L.LTypename(-1)))
+	le.value = L.NewRef(-1).SetFinalizer()
+	L.Pop(1)
+	panic(le)
+}
+
+// message of the errors whose value isn't a string, like the one of the lua interpreter
+func errorValueMessage(typename string) string {
+	return "(error object is a " + typename + " value)"
+}
+
+// Makes the go functions of the state raise their Go errors (see RaiseGoError)
+// as user data carrying the error instead of its message, so the *LuaError
+// returned by Call still unwraps to the Go error when lua code catches the
+// error and raises it again (with error(e) or error(e, 0)).
+//
+// tostring, the concatenation and the string methods (err:find) give the
+// message of such a value, but it isn't a string for type, ==, # or the
+// functions of the string library (string.find(err, ...)).
+func (L *State) SetGoErrorValues(enabled bool) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	L.MainCo.goErrorValues = enabled
+}
+
+// pushes the user data carrying le, raised by a go function with a Go error,
+// as the error value: raising it again from lua keeps the Go error, see callEx
+func (L *State) pushRaisedError(le *LuaError) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	// the metatable is created before the user data: lua_close calls the
+	// finalizers in the reverse order, the one of __gc must come last
+	if L.NewMetaTable(raisedErrorMetaTable) {
+		// hides the metatable from lua, its __gc must not be called twice
+		L.PushBoolean(false)
+		L.SetField(-2, "__metatable")
+		L.SetMetaMethod("__tostring", func(L *State) int {
+			L.PushString(L.toRaisedError(1).Msg)
+			return 1
+		})
+		L.SetMetaMethod("__concat", func(L *State) int {
+			var s [2]string
+			for i := range s {
+				if le := L.toRaisedError(i + 1); le != nil {
+					s[i] = le.Msg
+				} else if L.IsString(i + 1) {
+					s[i] = L.ToString(i + 1)
+				} else {
+					L.RaiseError("attempt to concatenate a " + L.LTypename(i+1) + " value")
+				}
+			}
+			L.PushString(s[0] + s[1])
+			return 1
+		})
+		C.clua_setraisederrorindex(L.s)
+		L.SetMetaMethod("__gc", func(L *State) int {
+			L.unregister(uint(*(*C.uint)(L.ToUserdata(1))))
+			return 0
+		})
+	}
+	L.Pop(1)
+	id := L.register(le)
+	ud := (*C.uint)(L.NewUserdata(unsafe.Sizeof(C.uint(0))))
+	*ud = C.uint(id)
+	L.LGetMetaTable(raisedErrorMetaTable)
+	L.SetMetaTable(-2)
+}
+
+// returns the *LuaError carried by the user data at index, nil if it isn't
+// a value pushed by pushRaisedError
+func (L *State) toRaisedError(index int) *LuaError {
+	if L.Type(index) != LUA_TUSERDATA || !L.GetMetaTable(index) {
+		return nil
+	}
+	L.LGetMetaTable(raisedErrorMetaTable)
+	same := L.RawEqual(-1, -2)
+	L.Pop(2)
+	if !same {
+		return nil
+	}
+	le, _ := L.Shared.registry[*(*C.uint)(L.ToUserdata(index))].(*LuaError)
+	return le
+}
+
 func (L *State) NewError(msg string) *LuaError {
 	return (&LuaError{}).New(L, 0, msg)
 }
@@ -141,7 +289,7 @@ func (L *State) LuaStack() []string {
 
 	top = L.GetTop()
 	L.PushThread()
-	L.ToThread(-1)
+	L.toThread(-1)
 	L.SetTop(top)
 	for i := top; i >= 1; i-- {
 		stack = append(stack, L.LuaStackPosToString(i))
@@ -209,7 +357,7 @@ func (L *State) DumpLuaStack() {
 func (L *State) DumpLuaStackAsString() (s string) {
 	top := L.GetTop()
 	isMain := L.PushThread()
-	thr := L.ToThread(-1)
+	thr := L.toThread(-1)
 	L.SetTop(top)
 	s += "==begin DumpLuaStack"
 	s += fmt.Sprintf(" (of coro %p/lua.State=%p; isMain=%v): top = %v\n", thr, thr.s, isMain, top)
@@ -0,0 +1,107 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A lua function held through a registry reference, see Ref.Call
+type Function struct {
+	*Ref
+}
+
+var typeOfFunction = reflect.TypeOf((*Function)(nil))
+
+// Returns a Function referencing the function at index, nil if the value isn't a function
+func (L *State) ToFunction(index int) *Function {
+	if !L.IsFunction(index) {
+		return nil
+	}
+	return &Function{L.NewRef(index)}
+}
+
+// Returns a Function referencing the global function name, which may be a
+// path of fields like "string.format"
+func (L *State) GetFunction(name string) (*Function, error) {
+	top := L.GetTop()
+	defer L.SetTop(top)
+	if err := L.pushFunction(name); err != nil {
+		return nil, err
+	}
+	return L.ToFunction(-1), nil
+}
+
+// Calls the global function name, which may be a path of fields like
+// "string.format", with args converted by PushGoValue and returns its results
+// converted like with Ref.Call. Lua errors are returned like with Call.
+func (L *State) CallFunction(name string, args ...interface{}) ([]interface{}, error) {
+	top := L.GetTop()
+	if err := L.pushFunction(name); err != nil {
+		L.SetTop(top)
+		return nil, err
+	}
+	return L.callValues(args)
+}
+
+// pushes the function found by following the dot separated fields of name from the globals,
+// the errors of the __index metamethods are returned
+func (L *State) pushFunction(name string) error {
+	L.PushValue(LUA_GLOBALSINDEX)
+	fields := strings.Split(name, ".")
+	for i, field := range fields {
+		if !L.IsTable(-1) {
+			L.Pop(1)
+			return fmt.Errorf("lua: %s is not a table", strings.Join(fields[:i], "."))
+		}
+		if err := L.getFieldEx(field); err != nil {
+			return err
+		}
+	}
+	if !L.IsFunction(-1) {
+		L.Pop(1)
+		return fmt.Errorf("lua: %s is not a function", name)
+	}
+	return nil
+}
+
+// Registers the Go function fn, of any function type, as the global name.
+//
+// The lua arguments are converted to the parameter types with ToValue, a
+// missing or wrong argument raises a "bad argument #n to 'name'" error,
+// the extra arguments of a variadic function fill its last parameter.
+// The results are pushed with PushGoValue, a trailing error result isn't
+// pushed and is raised with RaiseGoError when not nil.
+func (L *State) RegisterFunc(name string, fn interface{}) error {
+	if err := L.pushFunc(name, fn); err != nil {
+		return err
+	}
+	L.SetGlobal(name)
+	return nil
+}
+
+// pushes the Go function fn as a go function, name is used in the error messages
+func (L *State) pushFunc(name string, fn interface{}) error {
+	switch f := fn.(type) {
+	case LuaGoFunction:
+		L.PushGoFunction(f)
+		return nil
+	case func(*State) int:
+		L.PushGoFunction(f)
+		return nil
+	case LuaGoFunctionE:
+		L.PushGoFunctionE(f)
+		return nil
+	case func(*State) (int, error):
+		L.PushGoFunctionE(f)
+		return nil
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return fmt.Errorf("lua: %s must be a function, got %T", name, fn)
+	}
+	L.PushGoClosure(func(L *State) int {
+		return L.callReflect(name, fv, 1)
+	})
+	return nil
+}
@@ -0,0 +1,268 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Information about the event passed to a HookEventFunction, read with lua_getinfo
+type HookEvent struct {
+	Event       int    // LUA_HOOKCALL, LUA_HOOKRET, LUA_HOOKTAILRET, LUA_HOOKLINE or LUA_HOOKCOUNT
+	CurrentLine int    // current line of the running function, -1 if not available
+	Source      string // source of the chunk of the running function
+	ShortSrc    string // printable version of Source
+	Name        string // name of the running function, if any
+	NameWhat    string // "global", "local", "method", "field", "upvalue" or ""
+	What        string // "Lua", "C", "main" or "tail"
+}
+
+// This is the type of a go function that can be used as a hook receiving the event information
+type HookEventFunction func(L *State, ev HookEvent)
+
+// Ids of the hooks set by SetHook/SetHookMask, SetExecutionLimit and the Context functions
+const (
+	userHookID = iota
+	limitHookID
+	contextHookID
+	firstFreeHookID
+)
+
+// A go hook in the chain of hooks of a state
+type luaHook struct {
+	id    int
+	fn    HookEventFunction
+	mask  int
+	count int
+	left  int // instructions left before the next count event
+}
+
+// Sets the lua hook (lua_sethook) with the events selected by mask,
+// a combination of LUA_MASKCALL, LUA_MASKRET, LUA_MASKLINE and LUA_MASKCOUNT.
+// Like debug.sethook a positive count adds LUA_MASKCOUNT to the mask,
+// a nil f or an empty mask removes the hook.
+//
+// This replaces the hook set by SetHook, the hooks set by SetExecutionLimit
+// and AddHook are kept and called as well.
+//
+// A hook aborts the execution by panicking (RaiseError for instance): the
+// error is raised in lua at each instruction until it reaches the call from
+// Go, which returns it, so pcall can't catch it. The hooks are called again
+// after that.
+func (L *State) SetHookMask(f HookEventFunction, mask int, count int) {
+	L.setHook(userHookID, f, mask, count)
+}
+
+// Adds f to the hooks of the state, the other hooks are kept.
+// Returns the id to pass to RemoveHook.
+func (L *State) AddHook(f HookEventFunction, mask int, count int) int {
+	defer L.r.Unlock()
+	L.r.Lock()
+	main := L.MainCo
+	if main.nextHookID < firstFreeHookID {
+		main.nextHookID = firstFreeHookID
+	}
+	id := main.nextHookID
+	main.nextHookID++
+	L.setHook(id, f, mask, count)
+	return id
+}
+
+// Removes the hook added with AddHook
+func (L *State) RemoveHook(id int) {
+	if id >= firstFreeHookID {
+		L.setHook(id, nil, 0, 0)
+	}
+}
+
+// returns the hook with id, nil if it isn't set
+func (L *State) getHook(id int) *luaHook {
+	defer L.r.Unlock()
+	L.r.Lock()
+	for _, h := range L.MainCo.hooks {
+		if h.id == id {
+			return h
+		}
+	}
+	return nil
+}
+
+// sets (or removes when f is nil or mask is empty) the hook with id,
+// then updates the lua hook of the state to the union of the masks of the hooks
+func (L *State) setHook(id int, f HookEventFunction, mask int, count int) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	if count > 0 {
+		mask |= LUA_MASKCOUNT
+	} else {
+		mask &^= LUA_MASKCOUNT
+	}
+	if f == nil {
+		mask = 0
+	}
+
+	main := L.MainCo
+	hooks := make([]*luaHook, 0, len(main.hooks)+1)
+	for _, h := range main.hooks {
+		if h.id != id {
+			hooks = append(hooks, h)
+		}
+	}
+	if mask != 0 {
+		hooks = append(hooks, &luaHook{id: id, fn: f, mask: mask, count: count, left: count})
+		sort.Slice(hooks, func(i, j int) bool { return hooks[i].id < hooks[j].id })
+	}
+	main.hooks = hooks
+	L.updateHook()
+}
+
+// sets the lua hook of the state to the union of the masks of the hooks
+func (L *State) updateHook() {
+	defer L.r.Unlock()
+	L.r.Lock()
+	main := L.MainCo
+
+	// the count of the lua hook divides the counts of all the hooks
+	mask, count := 0, 0
+	for _, h := range main.hooks {
+		mask |= h.mask
+		if h.count > 0 {
+			count = gcd(count, h.count)
+		}
+	}
+	if main.hookErr != nil {
+		// the abort of a hook is raised again at each instruction, see callHooks
+		mask |= LUA_MASKCOUNT
+		count = 1
+	}
+	C.clua_sethook(L.s, C.int(mask), C.int(count))
+
+	if mask != 0 && !main.jitSuspended {
+		main.jitSuspended = C.clua_jit_suspend(L.s) != 0
+	} else if mask == 0 && main.jitSuspended {
+		main.jitSuspended = false
+		C.clua_jit_resume(L.s)
+	}
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Wraps the panics of the hooks on windows, where lua_error isn't used (see
+// callGoFunction): they unwind up to Call, which returns the wrapped value.
+// The lua state isn't unwound and its hooks are no longer called after
+// that, so the state refuses the next calls.
+type hookAbort struct {
+	v interface{}
+}
+
+var errHookAborted = errors.New("lua: the state has been aborted by a hook")
+
+// Calls the hooks interested in the event ar of the coroutine L1.
+//
+// A hook aborts the execution by panicking, with an error (like the
+// *LuaError of RaiseError) or any other value. The message of the error is
+// pushed and -1 returned, the C side raises it with lua_error. The error is
+// raised again at each instruction until the outermost call (Call, Resume...)
+// returns it, so pcall and coroutine.resume can't catch it.
+func (L1 *State) callHooks(ar *C.lua_Debug) (n int) {
+	main := L1.MainCo
+	if main.hookErr != nil {
+		L1.PushString(hookErrorMessage(main.hookErr))
+		return -1
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if ha, ok := r.(hookAbort); ok {
+			r = ha.v
+		}
+		if !raiseWithLuaError {
+			main.hookAborted = true
+			panic(hookAbort{r})
+		}
+		err, ok := r.(error)
+		if !ok {
+			err = (&LuaError{}).New(L1, LUA_ERRRUN, fmt.Sprint(r))
+		}
+		main.hookErr = err
+		L1.updateHook()
+		L1.PushString(hookErrorMessage(err))
+		n = -1
+	}()
+
+	event := int(ar.event)
+	var mask int
+	switch event {
+	case LUA_HOOKCALL:
+		mask = LUA_MASKCALL
+	case LUA_HOOKRET, LUA_HOOKTAILRET:
+		mask = LUA_MASKRET
+	case LUA_HOOKLINE:
+		mask = LUA_MASKLINE
+	case LUA_HOOKCOUNT:
+		mask = LUA_MASKCOUNT
+	}
+
+	var ev *HookEvent
+	// setHook replaces the slice, so the hooks can change the hooks while ranging over it
+	for _, h := range L1.MainCo.hooks {
+		if h.mask&mask == 0 {
+			continue
+		}
+		if mask == LUA_MASKCOUNT {
+			h.left -= int(C.lua_gethookcount(L1.s))
+			if h.left > 0 {
+				continue
+			}
+			h.left = h.count
+		}
+		if ev == nil {
+			C.clua_hookinfo(L1.s, ar)
+			ev = &HookEvent{
+				Event:       event,
+				CurrentLine: int(ar.currentline),
+				Source:      C.GoString(ar.source),
+				ShortSrc:    C.GoString(&ar.short_src[0]),
+				Name:        C.GoString(ar.name),
+				NameWhat:    C.GoString(ar.namewhat),
+				What:        C.GoString(ar.what),
+			}
+		}
+		h.fn(L1, *ev)
+	}
+	return 0
+}
+
+func hookErrorMessage(err error) string {
+	if le, ok := err.(*LuaError); ok {
+		return le.Msg
+	}
+	return err.Error()
+}
+
+// Returns the error of the hook that aborted the execution, nil if there is
+// none. The outermost call clears it, restoring the hooks.
+func (L *State) hookAbortError() error {
+	main := L.MainCo
+	err := main.hookErr
+	if err != nil && main.callDepth <= 1 {
+		main.hookErr = nil
+		L.updateHook()
+	}
+	return err
+}
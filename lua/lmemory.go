@@ -0,0 +1,65 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"errors"
+)
+
+// Matches (with errors.Is) the *LuaError returned when an allocation is refused by the limit set with SetMemoryLimit
+var ErrMemoryLimit = errors.New("lua memory limit exceeded")
+
+// Is reports whether target is ErrMemoryLimit and the error comes from an
+// allocation refused by the limit, not from another LUA_ERRMEM error
+func (le *LuaError) Is(target error) bool {
+	return target == ErrMemoryLimit && le.memoryLimitHit
+}
+
+// Sets the maximum number of bytes allocated by the state, 0 for no limit.
+//
+// The allocation function of the state (see SetAllocf) is wrapped to count
+// the allocated bytes, including the ones allocated before the call.
+// Allocations past the limit fail and the call returns a *LuaError with
+// code LUA_ERRMEM matching ErrMemoryLimit. Lua doesn't collect the garbage
+// when an allocation fails, so GC(LUA_GCCOLLECT, 0) may be needed after it.
+func (L *State) SetMemoryLimit(bytes int) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	main := L.MainCo
+	if main.memlimit == nil {
+		main.memlimit = C.clua_setmemlimit(main.s)
+		if main.memlimit == nil {
+			panic("lua: cannot allocate the memory limit")
+		}
+	}
+	if bytes < 0 {
+		bytes = 0
+	}
+	main.memlimit.limit = C.size_t(bytes)
+}
+
+// Returns the number of bytes allocated by the state
+func (L *State) MemoryUsage() int {
+	defer L.r.Unlock()
+	L.r.Lock()
+	if m := L.MainCo.memlimit; m != nil {
+		return int(m.used)
+	}
+	return int(C.lua_gc(L.s, LUA_GCCOUNT, 0))*1024 + int(C.lua_gc(L.s, LUA_GCCOUNTB, 0))
+}
+
+// returns true (once) if an allocation has been refused by the memory limit
+func (L *State) memoryLimitHit() bool {
+	m := L.MainCo.memlimit
+	if m == nil || m.refused == 0 {
+		return false
+	}
+	m.refused = 0
+	return true
+}
@@ -0,0 +1,131 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// Default pattern of AddModuleFS
+const defaultModuleFSPattern = "?.lua;?/init.lua"
+
+// Registers a Go module loaded by require(name).
+//
+// A loader is installed into package.preload[name], the module table is
+// created by the first require with the functions of funcs (pushed with
+// PushGoClosure) and the fields of fields converted with PushGoValue, then
+// it is kept in package.loaded by require. name may be a nested name like
+// "company.http", no global is set. The package library must be opened.
+func (L *State) RegisterModule(name string, funcs map[string]LuaGoFunction, fields map[string]interface{}) error {
+	// later changes of the maps don't change the module
+	fns := make(map[string]LuaGoFunction, len(funcs))
+	for k, f := range funcs {
+		fns[k] = f
+	}
+	vs := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		vs[k] = v
+	}
+
+	return L.setPreload(name, func(L *State) int {
+		L.CreateTable(0, len(fns)+len(vs))
+		for k, f := range fns {
+			L.PushGoClosure(f)
+			L.SetField(-2, k)
+		}
+		for k, v := range vs {
+			if err := L.PushGoValue(v); err != nil {
+				L.RaiseError(fmt.Sprintf("module '%s': field '%s': %s", name, k, err.Error()))
+			}
+			L.SetField(-2, k)
+		}
+		return 1
+	})
+}
+
+// sets package.preload[name] to the loader
+func (L *State) setPreload(name string, loader LuaGoFunction) error {
+	top := L.GetTop()
+	defer L.SetTop(top)
+	L.GetField(LUA_REGISTRYINDEX, "_LOADED")
+	L.GetField(-1, "package")
+	if !L.IsTable(-1) {
+		return errors.New("lua: the package library isn't opened")
+	}
+	L.GetField(-1, "preload")
+	if !L.IsTable(-1) {
+		return errors.New("lua: package.preload isn't a table")
+	}
+	// require only calls lua functions, not the user data of PushGoFunction
+	L.PushGoClosure(loader)
+	L.SetField(-2, name)
+	return nil
+}
+
+// Adds a searcher of lua modules in fsys to package.loaders, after the preload searcher.
+//
+// pattern is a list of templates separated by semicolons like package.path,
+// the module name, with its dots replaced by slashes, is substituted to the
+// question marks: with the default pattern "?.lua;?/init.lua" require("a.b.c")
+// loads a/b/c.lua or a/b/c/init.lua. The chunks are named after their path
+// in fsys (like "@a/b/c.lua"), text and binary chunks are accepted.
+// The package library must be opened.
+func (L *State) AddModuleFS(fsys fs.FS, pattern string) error {
+	if pattern == "" {
+		pattern = defaultModuleFSPattern
+	}
+	templates := strings.Split(pattern, ";")
+
+	top := L.GetTop()
+	defer L.SetTop(top)
+	L.GetField(LUA_REGISTRYINDEX, "_LOADED")
+	L.GetField(-1, "package")
+	if !L.IsTable(-1) {
+		return errors.New("lua: the package library isn't opened")
+	}
+	L.GetField(-1, "loaders")
+	if !L.IsTable(-1) {
+		return errors.New("lua: package.loaders isn't a table")
+	}
+	loaders := L.GetTop()
+
+	// shifts the searchers after the preload one (table.insert(loaders, 2, searcher))
+	n := int(L.ObjLen(loaders))
+	for i := n; i >= 2; i-- {
+		L.RawGeti(loaders, i)
+		L.RawSeti(loaders, i+1)
+	}
+	L.PushGoClosure(func(L *State) int {
+		return L.searchModuleFS(fsys, templates)
+	})
+	L.RawSeti(loaders, 2)
+	return nil
+}
+
+// searcher of AddModuleFS, pushes the loader of the module or the list of files tried
+func (L *State) searchModuleFS(fsys fs.FS, templates []string) int {
+	name := L.CheckString(1)
+	base := strings.ReplaceAll(name, ".", "/")
+	var tried strings.Builder
+	for _, t := range templates {
+		path := strings.ReplaceAll(t, "?", base)
+		if !fs.ValidPath(path) {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(&tried, "\n\tno file '%s' in fs", path)
+			continue
+		}
+		if err != nil {
+			L.RaiseError(fmt.Sprintf("error loading module '%s' from file '%s':\n\t%s", name, path, err.Error()))
+		}
+		if err := L.LoadChunk(b, "@"+path, "bt"); err != nil {
+			L.RaiseError(fmt.Sprintf("error loading module '%s' from file '%s':\n\t%s", name, path, err.(*LuaError).Msg))
+		}
+		return 1
+	}
+	L.PushString(tried.String())
+	return 1
+}
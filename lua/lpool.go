@@ -0,0 +1,264 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Returned by Pool.Get after Pool.Close
+var ErrPoolClosed = errors.New("lua: pool closed")
+
+// Options of NewPool
+type PoolOptions struct {
+	// Called once on every new state, after OpenLibs and before the baseline
+	// of the globals is taken. A state whose Init fails is closed and the
+	// error is returned by Get.
+	Init func(L *State) error
+
+	// Modules required after Init, they stay in package.loaded between the uses of a state
+	Preload []string
+
+	// Maximum number of states handed out by Get at the same time, 0 for no limit.
+	// Get waits for a Put when reached.
+	MaxStates int
+
+	// Maximum number of idle states kept by the pool, 0 for MaxStates (no limit when both are 0)
+	MaxIdle int
+
+	// Number of states created by NewPool
+	WarmUp int
+
+	// Memory limit of every state, see SetMemoryLimit
+	MemoryLimit int
+}
+
+// A pool of initialized lua states.
+//
+// A state is initialized once (OpenLibs, Init and Preload), then it is
+// handed out by Get and returned with Put, which resets its globals and
+// package.loaded to the baseline taken after the initialization. The content
+// and the metatable of the tables they hold, like string or the modules of
+// Preload, and the metatables of _G and of the strings are restored too, but
+// not the tables nested deeper or the upvalues of the functions. Hooks added while the state is out of the pool are not removed.
+//
+// Put closes the states that can't be reused: the ones where a call returned
+// an error (including ErrMemoryLimit) or where the execution has been aborted
+// by a hook, like with SetExecutionLimit or DoStringContext.
+type Pool struct {
+	opts PoolOptions
+
+	// one token per state handed out, nil without MaxStates
+	sem chan struct{}
+
+	mu     sync.Mutex
+	idle   []*State
+	closed bool
+}
+
+// Name of the reset function in the registry of a pooled state
+const poolResetKey = "GoLua.PoolReset"
+
+// Takes the baseline of the globals, of package.loaded, of the tables they
+// hold and of their metatables, returns the function restoring them
+const luaPoolBaselineScript = `
+local next, rawset, type = next, rawset, type
+local getmetatable = debug and debug.getmetatable or getmetatable
+local setmetatable = debug and debug.setmetatable or setmetatable
+local G, loaded = _G, package and package.loaded
+
+local base, metatables = {}, {}
+local function snapshot(t, deep)
+	local s = {}
+	for k, v in next, t do
+		s[k] = v
+	end
+	base[t] = s
+	metatables[t] = getmetatable(t) or false
+	if deep then
+		for _, v in next, s do
+			if type(v) == "table" and base[v] == nil then
+				snapshot(v, false)
+			end
+		end
+	end
+end
+
+local function restore(t, base)
+	for k in next, t do
+		if base[k] == nil then
+			rawset(t, k, nil)
+		end
+	end
+	for k, v in next, base do
+		rawset(t, k, v)
+	end
+end
+
+snapshot(G, true)
+if loaded then
+	snapshot(loaded, true)
+end
+local strmt = getmetatable("")
+if strmt then
+	snapshot(strmt, false)
+end
+return function()
+	for t, s in next, base do
+		restore(t, s)
+		setmetatable(t, metatables[t] or nil)
+	end
+end
+`
+
+// Creates a pool and the opts.WarmUp first states
+func NewPool(opts PoolOptions) (*Pool, error) {
+	if opts.MaxStates > 0 && opts.WarmUp > opts.MaxStates {
+		opts.WarmUp = opts.MaxStates
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = opts.MaxStates
+	}
+	p := &Pool{opts: opts}
+	if opts.MaxStates > 0 {
+		p.sem = make(chan struct{}, opts.MaxStates)
+	}
+	for i := 0; i < opts.WarmUp; i++ {
+		L, err := p.newState()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle = append(p.idle, L)
+	}
+	return p, nil
+}
+
+// Returns an idle state or a new one, waits while MaxStates states are handed out.
+// The state must be given back with Put and used by one goroutine at a time.
+func (p *Pool) Get(ctx context.Context) (*State, error) {
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.release()
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		L := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return L, nil
+	}
+	p.mu.Unlock()
+
+	L, err := p.newState()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return L, nil
+}
+
+// Gives back a state obtained with Get, it is reset or closed when it can't be reused
+func (p *Pool) Put(L *State) {
+	defer p.release()
+	if !p.reset(L) {
+		L.Close()
+		return
+	}
+
+	p.mu.Lock()
+	if p.closed || (p.opts.MaxIdle > 0 && len(p.idle) >= p.opts.MaxIdle) {
+		p.mu.Unlock()
+		L.Close()
+		return
+	}
+	p.idle = append(p.idle, L)
+	p.mu.Unlock()
+}
+
+// Closes the idle states, the states handed out are closed by Put
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, L := range idle {
+		L.Close()
+	}
+}
+
+func (p *Pool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+func (p *Pool) newState() (*State, error) {
+	L := NewState()
+	if L == nil {
+		return nil, errors.New("lua: cannot create state")
+	}
+	if err := p.initState(L); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+func (p *Pool) initState(L *State) error {
+	L.OpenLibs()
+	if p.opts.Init != nil {
+		if err := p.opts.Init(L); err != nil {
+			return err
+		}
+	}
+	for _, name := range p.opts.Preload {
+		L.GetGlobal("require")
+		L.PushString(name)
+		if err := L.Call(1, 0); err != nil {
+			return err
+		}
+	}
+	L.SetTop(0)
+
+	if r := L.LoadString(luaPoolBaselineScript); r != 0 {
+		return (&LuaError{}).New(L, r, L.ToString(-1))
+	}
+	if err := L.Call(0, 1); err != nil {
+		return err
+	}
+	L.SetField(LUA_REGISTRYINDEX, poolResetKey)
+
+	// the errors handled by Init don't evict the state
+	L.failed = false
+	L.GC(LUA_GCCOLLECT, 0)
+	if p.opts.MemoryLimit > 0 {
+		L.SetMemoryLimit(p.opts.MemoryLimit)
+	}
+	return nil
+}
+
+// restores the baseline of the state, returns false when the state must be closed
+func (p *Pool) reset(L *State) bool {
+	L = L.MainCo
+	if L.hookAborted || L.failed {
+		return false
+	}
+	L.SetTop(0)
+	L.GetField(LUA_REGISTRYINDEX, poolResetKey)
+	if err := L.Call(0, 0); err != nil {
+		return false
+	}
+	L.GC(LUA_GCCOLLECT, 0)
+	return true
+}
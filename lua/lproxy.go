@@ -0,0 +1,304 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Name of the metatable of the user data pushed with PushGoStruct, see c-golua.c
+const mtGoInterface = "GoLua.GoInterface"
+
+// Error of the assignments to the proxies over the elements of maps
+const errMapElement = "cannot assign to map element"
+
+// Pushes a value read from a field or element of a Go object.
+//
+// Values of simple types are copied, structs, maps, slices and arrays are
+// pushed as proxy user data sharing the underlying Go value, functions are
+// pushed as callable go functions.
+// When v can't be modified in place (it isn't addressable, or readOnly is the
+// error of its assignments, ignored after a pointer), structs and arrays
+// are pushed as read-only proxies over a copy, their assignments raise
+// readOnly, maps and slices still share their elements but can't be replaced
+// (append, creation of a nil map).
+// Returns false if v has a type that can't be represented in lua.
+func (L *State) pushProxyValue(name string, v reflect.Value, readOnly string) bool {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			L.PushNil()
+			return true
+		}
+		if v.Kind() == reflect.Ptr {
+			// the pointed value is shared
+			readOnly = ""
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		L.PushNil()
+		return true
+	}
+	if L.pushScalar(v) {
+		return true
+	}
+
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		if readOnly == "" && !v.CanAddr() {
+			readOnly = "cannot assign to a copy of " + name
+		}
+		if readOnly == "" {
+			L.PushGoStruct(v.Addr().Interface())
+		} else if v.Kind() == reflect.Map || v.Kind() == reflect.Slice {
+			L.PushGoStruct(v.Interface())
+		} else {
+			cp := reflect.New(v.Type())
+			cp.Elem().Set(v)
+			L.pushReadOnlyGoStruct(cp.Interface(), readOnly)
+		}
+		return true
+
+	case reflect.Func:
+		if v.IsNil() {
+			L.PushNil()
+		} else if v.Type() == typeOfLuaGoFunction {
+			L.PushGoFunction(v.Interface().(LuaGoFunction))
+		} else {
+			L.PushGoClosure(func(L *State) int {
+				return L.callReflect(name, v, 1)
+			})
+		}
+		return true
+	}
+	return false
+}
+
+// Converts the lua value at index into a 0 based index of a Go slice or array of length n,
+// returns -1 for values that aren't integer numbers, n for the first index after the end
+func (L *State) toSliceIndex(index int, n int) int {
+	if L.Type(index) != LUA_TNUMBER {
+		return -1
+	}
+	f := L.ToNumber(index)
+	if f != math.Trunc(f) || f < 1 || f > float64(n)+1 {
+		return -1
+	}
+	return int(f) - 1
+}
+
+// Implements __index for proxies of maps, slices and arrays.
+// Returns the number of values pushed or -1 with an error message on the stack.
+func (L *State) indexContainer(v reflect.Value, kidx int) int {
+	switch v.Kind() {
+	case reflect.Map:
+		key, err := L.toReflectValue(kidx, v.Type().Key())
+		if err != nil || v.IsNil() {
+			L.PushNil()
+			return 1
+		}
+		e := v.MapIndex(key)
+		if !e.IsValid() {
+			L.PushNil()
+			return 1
+		}
+		if L.pushProxyValue(fmt.Sprint(key.Interface()), e, errMapElement) {
+			return 1
+		}
+		L.PushString("Unsupported type of map element: " + e.Type().String())
+		return -1
+
+	case reflect.Slice, reflect.Array:
+		i := L.toSliceIndex(kidx, v.Len())
+		if i < 0 || i >= v.Len() {
+			L.PushNil()
+			return 1
+		}
+		// the elements of slices are shared by their copies, not those of arrays
+		readOnly := ""
+		if v.Kind() == reflect.Array {
+			readOnly = L.proxyReadOnly()
+		}
+		e := v.Index(i)
+		if L.pushProxyValue(fmt.Sprint(i+1), e, readOnly) {
+			return 1
+		}
+		L.PushString("Unsupported type of element: " + e.Type().String())
+		return -1
+	}
+
+	L.PushString("Unsupported type of object: " + v.Type().String())
+	return -1
+}
+
+// Implements __newindex for proxies of maps, slices and arrays.
+// Returns 1 or -1 with an error message on the stack.
+func (L *State) newindexContainer(v reflect.Value, kidx int, vidx int) int {
+	switch v.Kind() {
+	case reflect.Map:
+		key, err := L.toReflectValue(kidx, v.Type().Key())
+		if err != nil {
+			L.PushString("Wrong key for map " + v.Type().String() + ": " + err.Error())
+			return -1
+		}
+		if L.IsNil(vidx) {
+			if !v.IsNil() {
+				v.SetMapIndex(key, reflect.Value{})
+			}
+			return 1
+		}
+		e, err := L.toReflectValue(vidx, v.Type().Elem())
+		if err != nil {
+			L.PushString("Wrong assignment to map element: " + err.Error())
+			return -1
+		}
+		if v.IsNil() {
+			if !v.CanSet() {
+				L.PushString("Assignment to nil map")
+				return -1
+			}
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(key, e)
+		return 1
+
+	case reflect.Slice, reflect.Array:
+		i := L.toSliceIndex(kidx, v.Len())
+		if i < 0 || (i == v.Len() && (v.Kind() == reflect.Array || !v.CanSet())) {
+			L.PushString(fmt.Sprintf("Index out of range [1, %d]", v.Len()))
+			return -1
+		}
+		e, err := L.toReflectValue(vidx, v.Type().Elem())
+		if err != nil {
+			L.PushString("Wrong assignment to element: " + err.Error())
+			return -1
+		}
+		if i == v.Len() {
+			v.Set(reflect.Append(v, e))
+			return 1
+		}
+		if !v.Index(i).CanSet() {
+			L.PushString("Element is not assignable")
+			return -1
+		}
+		v.Index(i).Set(e)
+		return 1
+	}
+
+	L.PushString("Unsupported type of object: " + v.Type().String())
+	return -1
+}
+
+// Returns the value of the Go struct user data at index 1 after following pointers
+func (L *State) proxyTarget() reflect.Value {
+	if !L.IsGoStruct(1) {
+		L.raiseArgumentError(1, LUA_TUSERDATA)
+	}
+	return reflect.Indirect(reflect.ValueOf(L.ToGoStruct(1)))
+}
+
+// __len metamethod of Go struct user data
+func goStructLen(L *State) int {
+	v := L.proxyTarget()
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+		L.PushInteger(int64(v.Len()))
+		return 1
+	}
+	L.RaiseError("attempt to get length of Go " + v.Type().String())
+	return 0
+}
+
+// __pairs metamethod of Go struct user data, iterates over the exported fields
+// of structs, the elements of slices and arrays, and a snapshot of the keys of maps
+func goStructPairs(L *State) int {
+	v := L.proxyTarget()
+	pos := 0
+	var next func(L *State) int
+
+	switch v.Kind() {
+	case reflect.Struct:
+		next = func(L *State) int {
+			for ; pos < v.NumField(); pos++ {
+				name, _, skip := luaFieldName(v.Type().Field(pos))
+				if skip {
+					continue
+				}
+				f := v.Field(pos)
+				pos++
+				L.PushString(name)
+				if !L.pushProxyValue(name, f, L.proxyReadOnly()) {
+					L.RaiseError("Unsupported type of field: " + f.Type().String())
+				}
+				return 2
+			}
+			return 0
+		}
+
+	case reflect.Map:
+		keys := v.MapKeys()
+		next = func(L *State) int {
+			for ; pos < len(keys); pos++ {
+				e := v.MapIndex(keys[pos])
+				if !e.IsValid() {
+					// deleted during the iteration
+					continue
+				}
+				k := keys[pos]
+				pos++
+				if err := L.PushGoValue(k.Interface()); err != nil {
+					L.RaiseError(err.Error())
+				}
+				if !L.pushProxyValue(fmt.Sprint(k.Interface()), e, errMapElement) {
+					L.RaiseError("Unsupported type of map element: " + e.Type().String())
+				}
+				return 2
+			}
+			return 0
+		}
+
+	case reflect.Slice, reflect.Array:
+		return goStructIpairs(L)
+
+	default:
+		L.RaiseError("attempt to iterate over Go " + v.Type().String())
+	}
+
+	L.PushGoClosure(next)
+	L.PushValue(1)
+	L.PushNil()
+	return 3
+}
+
+// __ipairs metamethod of Go struct user data, iterates over t[1], t[2], ... until the first nil
+func goStructIpairs(L *State) int {
+	L.PushGoClosure(func(L *State) int {
+		v := L.proxyTarget()
+		i := L.CheckInteger(2) + 1
+		if v.Kind() == reflect.Struct {
+			return 0
+		}
+		L.PushInteger(int64(i))
+		L.PushInteger(int64(i))
+		if L.indexContainer(v, L.GetTop()) < 0 {
+			L.RaiseError(L.ToString(-1))
+		}
+		if L.IsNil(-1) {
+			return 0
+		}
+		L.Remove(-2)
+		return 2
+	})
+	L.PushValue(1)
+	L.PushInteger(0)
+	return 3
+}
+
+// installs the Go side metamethods of the PushGoStruct user data
+func (L *State) initGoStructMetaMethods() {
+	L.LGetMetaTable(mtGoInterface)
+	L.SetMetaMethod("__len", goStructLen)
+	L.SetMetaMethod("__pairs", goStructPairs)
+	L.SetMetaMethod("__ipairs", goStructIpairs)
+	L.Pop(1)
+}
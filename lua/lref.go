@@ -0,0 +1,119 @@
+package lua
+
+import (
+	"runtime"
+)
+
+// A reference to a lua value stored in the registry, see NewRef.
+//
+// A Ref keeps the value alive until Release is called. It belongs to the
+// state that created it and must be used like the state, from one goroutine
+// at a time.
+type Ref struct {
+	// the main coroutine of the state
+	L *State
+
+	ref int
+}
+
+// Stores the value at index in the registry (luaL_ref) and returns its reference.
+// The value is left on the stack.
+func (L *State) NewRef(index int) *Ref {
+	defer L.r.Unlock()
+	L.r.Lock()
+	L.releaseDeadRefs()
+	L.PushValue(index)
+	return &Ref{L: L.MainCo, ref: L.Ref(LUA_REGISTRYINDEX)}
+}
+
+// Sets a finalizer releasing the reference when the Ref is garbage collected
+// by Go. The finalizer doesn't touch the lua state, the release is done by the
+// goroutine using the state on its next NewRef or call (see Call).
+// Returns r.
+func (r *Ref) SetFinalizer() *Ref {
+	runtime.SetFinalizer(r, (*Ref).finalize)
+	return r
+}
+
+// Pushes the referenced value onto the stack of the main coroutine,
+// nil if the reference has been released
+func (r *Ref) Push() {
+	r.PushTo(r.L)
+}
+
+// Like Push but onto the stack of L, a coroutine of the state of the reference
+func (r *Ref) PushTo(L *State) {
+	if r.released() {
+		L.PushNil()
+		return
+	}
+	L.RawGeti(LUA_REGISTRYINDEX, r.ref)
+}
+
+// Returns the type of the referenced value, LUA_TNONE if the reference has been released
+func (r *Ref) Type() LuaValType {
+	if r.released() {
+		return LUA_TNONE
+	}
+	defer r.L.r.Unlock()
+	r.L.r.Lock()
+	r.Push()
+	defer r.L.Pop(1)
+	return r.L.Type(-1)
+}
+
+// Calls the referenced value on the main coroutine with args converted by
+// PushGoValue and returns its results converted into interface{} values
+// (see ToValue), the results that can't be converted, like functions,
+// are returned as references (see Value). Lua errors are returned like with Call.
+func (r *Ref) Call(args ...interface{}) ([]interface{}, error) {
+	defer r.L.r.Unlock()
+	r.L.r.Lock()
+	r.Push()
+	return r.L.callValues(args)
+}
+
+// Removes the value from the registry (luaL_unref), the Ref can't be used after that.
+// Release can be called more than once and after the state has been closed.
+func (r *Ref) Release() {
+	L := r.L
+	defer L.r.Unlock()
+	L.r.Lock()
+	if r.ref == LUA_NOREF {
+		return
+	}
+	runtime.SetFinalizer(r, nil)
+	if !L.MainCo.closed {
+		L.Unref(LUA_REGISTRYINDEX, r.ref)
+	}
+	r.ref = LUA_NOREF
+}
+
+func (r *Ref) released() bool {
+	defer r.L.r.Unlock()
+	r.L.r.Lock()
+	return r.ref == LUA_NOREF || r.L.MainCo.closed
+}
+
+// runs on the finalizer goroutine: the state may be in use, the reference
+// is only queued, see releaseDeadRefs
+func (r *Ref) finalize() {
+	main := r.L.MainCo
+	main.deadRefsMu.Lock()
+	defer main.deadRefsMu.Unlock()
+	if r.ref != LUA_NOREF && !main.closed {
+		main.deadRefs = append(main.deadRefs, r.ref)
+	}
+}
+
+// releases the references queued by the finalizers, called with the lock held
+func (L *State) releaseDeadRefs() {
+	main := L.MainCo
+	main.deadRefsMu.Lock()
+	refs := main.deadRefs
+	main.deadRefs = nil
+	main.deadRefsMu.Unlock()
+	for _, ref := range refs {
+		L.Unref(LUA_REGISTRYINDEX, ref)
+	}
+}
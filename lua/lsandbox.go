@@ -0,0 +1,120 @@
+package lua
+
+import (
+	"errors"
+)
+
+// Options of NewSandbox and ApplySandbox
+type SandboxOptions struct {
+	// Maximum number of bytes allocated by the state, 0 for no limit.
+	// When reached the allocations fail with ErrMemoryLimit, see SetMemoryLimit.
+	MemoryLimit int
+
+	// Maximum number of instructions executed by the state, 0 for no limit.
+	// When reached the execution ends like with SetExecutionLimit.
+	InstructionLimit int
+
+	// Opens the package library, require is limited to the modules of
+	// package.preload and to the lua files found in PackagePath (none if empty)
+	Package     bool
+	PackagePath string
+}
+
+// Lua side of ApplySandbox, called with the package path or nil when the package library isn't allowed
+const luaSandboxScript = `
+local path = ...
+local sysload, sysos = load, os
+
+dofile, loadfile = nil, nil
+io, debug, jit, ffi = nil, nil, nil, nil
+
+-- text chunks only, bytecode can break the VM
+function load(chunk, chunkname, mode, env)
+	return sysload(chunk, chunkname, "t", env)
+end
+function loadstring(s, chunkname)
+	return sysload(s, chunkname, "t")
+end
+
+os = {
+	clock = sysos.clock,
+	date = sysos.date,
+	difftime = sysos.difftime,
+	time = sysos.time,
+}
+
+if not path then
+	package, require, module = nil, nil, nil
+	return
+end
+
+package.loadlib = nil
+package.cpath = ""
+package.path = path
+-- keeps the preload and lua searchers only
+local loaders = package.loaders
+for i = #loaders, 3, -1 do
+	loaders[i] = nil
+end
+for _, name in ipairs({"io", "debug", "jit", "jit.util", "jit.opt", "jit.profile", "ffi"}) do
+	package.loaded[name] = nil
+	package.preload[name] = nil
+end
+package.loaded.os = os
+`
+
+// Creates a new lua state for untrusted scripts, see ApplySandbox
+func NewSandbox(opts SandboxOptions) (*State, error) {
+	L := NewState()
+	if L == nil {
+		return nil, errors.New("lua: cannot create state")
+	}
+	if err := L.ApplySandbox(opts); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// Restricts the state to run untrusted scripts.
+//
+// The base, string, table and math libraries are opened, and os with only
+// clock, date, difftime and time. dofile, loadfile, io, debug, jit and ffi
+// are removed and load and loadstring only accept text chunks. Unlike
+// OpenLibs no bundle loader or bundle main routine is installed.
+// With opts.Package require can only load the modules of package.preload
+// and the lua files of opts.PackagePath, C modules and package.loadlib are removed.
+//
+// The memory limit counts all the memory of the state, including what was
+// allocated before the call. The limits are set at the end, after the
+// sandbox has been set up.
+func (L *State) ApplySandbox(opts SandboxOptions) error {
+	L.OpenBase()
+	L.OpenString()
+	L.OpenTable()
+	L.OpenMath()
+	L.OpenOS()
+	if opts.Package {
+		L.OpenPackage()
+	}
+
+	if r := L.LoadString(luaSandboxScript); r != 0 {
+		return (&LuaError{}).New(L, r, L.ToString(-1))
+	}
+	if opts.Package {
+		L.PushString(opts.PackagePath)
+	} else {
+		L.PushNil()
+	}
+	if err := L.Call(1, 0); err != nil {
+		return err
+	}
+
+	if opts.MemoryLimit > 0 {
+		L.SetMemoryLimit(opts.MemoryLimit)
+	}
+	if opts.InstructionLimit > 0 {
+		L.SetExecutionLimit(opts.InstructionLimit)
+	}
+	return nil
+}
@@ -99,6 +99,11 @@ func (L *State) CreateTable(narr int, nrec int) {
 	C.lua_createtable(L.s, C.int(narr), C.int(nrec))
 }
 
+// Like PushGoFunction for a go function returning an error, see LuaGoFunctionE
+func (L *State) PushGoFunctionE(f LuaGoFunctionE) {
+	L.PushGoFunction(f.luaGoFunction())
+}
+
 // Like lua_pushcfunction pushes onto the stack a go function as user data
 func (L *State) PushGoFunction(f LuaGoFunction) {
 	defer L.r.Unlock()
@@ -132,7 +137,13 @@ func (L *State) PushUint64(u uint64) {
 // Pushes a Go struct onto the stack as user data.
 //
 // The user data will be rigged so that lua code can access
-// and change the public members of simple types directly
+// and change the public members of simple types directly,
+// and call the exported methods with obj:Method(...).
+// Fields holding structs, maps, slices and arrays are exposed as
+// proxies sharing the Go value, they support indexing, assignment,
+// the length operator, pairs and ipairs.
+// Method arguments and results are converted like ToValue and
+// PushGoValue do, a non nil trailing error result is raised as a lua error.
 func (L *State) PushGoStruct(iface interface{}) {
 	defer L.r.Unlock()
 	L.r.Lock()
@@ -140,6 +151,15 @@ func (L *State) PushGoStruct(iface interface{}) {
 	C.clua_pushgostruct(L.s, C.uint(iid))
 }
 
+// Pushes iface like PushGoStruct, assigning it raises msg
+func (L *State) pushReadOnlyGoStruct(iface interface{}, msg string) {
+	defer L.r.Unlock()
+	L.r.Lock()
+	iid := L.register(iface)
+	L.Shared.readOnly[iid] = msg
+	C.clua_pushgostruct(L.s, C.uint(iid))
+}
+
 // Push a pointer onto the stack as user data.
 //
 // This function doesn't save a reference to the interface,
@@ -8,6 +8,7 @@ package lua
 */
 import "C"
 import (
+	"fmt"
 	"unsafe"
 
 	"github.com/vxcontrol/rmx"
@@ -23,9 +24,10 @@ func NewState() *State {
 	return L
 }
 
-// Creates a new lua interpreter state with the given allocation function
+// Creates a new lua interpreter state with the given allocation function.
+// Lua keeps the returned pointers, so f must return C memory (not Go memory),
+// see _example/alloc.go
 func NewStateAlloc(f Alloc) *State {
-	// jea: ../example/alloc.go panics... hmm.
 	ls := C.clua_newstate(unsafe.Pointer(&f))
 	L := newState(ls)
 	L.allocfn = &f
@@ -73,11 +75,28 @@ func (L *State) Register(name string, f LuaGoFunction) {
 	L.SetGlobal(name)
 }
 
-// lua_close
+// Like Register for a go function returning an error, see LuaGoFunctionE
+func (L *State) RegisterE(name string, f LuaGoFunctionE) {
+	L.PushGoFunctionE(f)
+	L.SetGlobal(name)
+}
+
+// lua_close, does nothing if the state is already closed
 func (L *State) Close() {
 	defer L.r.Unlock()
 	L.r.Lock()
+	if L.MainCo.closed {
+		return
+	}
 	C.lua_close(L.s)
+	L.MainCo.deadRefsMu.Lock()
+	L.MainCo.closed = true
+	L.MainCo.deadRefs = nil
+	L.MainCo.deadRefsMu.Unlock()
+	if L.memlimit != nil {
+		C.free(unsafe.Pointer(L.memlimit))
+		L.memlimit = nil
+	}
 	unregisterGoState(L)
 }
 
@@ -104,6 +123,7 @@ func newState(L *C.lua_State) *State {
 	}
 	newstate.MainCo.AllCoro[newstate.Upos] = newstate
 	C.clua_initstate(L)
+	newstate.initGoStructMetaMethods()
 	return newstate
 }
 
@@ -135,6 +155,7 @@ func (L *State) register(f interface{}) uint {
 func (L *State) unregister(fid uint) {
 	if (fid < uint(len(L.Shared.registry))) && (L.Shared.registry[fid] != nil) {
 		L.Shared.registry[fid] = nil
+		delete(L.Shared.readOnly, fid)
 		L.Shared.freeIndices = append(L.Shared.freeIndices, fid)
 	}
 }
@@ -176,23 +197,71 @@ func (L *State) pcall(nargs, nresults, errfunc int) int {
 	return int(C.lua_pcall(L.s, C.int(nargs), C.int(nresults), C.int(errfunc)))
 }
 
-func (L *State) callEx(nargs, nresults int) (err error) {
+func (L *State) callEx(nargs, nresults int) error {
+	return L.callProtected(nargs, nresults, false)
+}
+
+// callEx for the protected calls done by the bindings (table accesses...):
+// their errors are returned to go and don't mark the state as failed
+func (L *State) callInternal(nargs, nresults int) error {
+	return L.callProtected(nargs, nresults, true)
+}
+
+func (L *State) callProtected(nargs, nresults int, internal bool) (err error) {
+	main := L.MainCo
+	main.callDepth++
+	defer func() { main.callDepth-- }()
+	// only the errors returned by the outermost call mark the state as
+	// failed (see Pool), the nested calls may be handled by a go function
+	setFailed := func() {
+		if !internal && main.callDepth == 1 {
+			main.failed = true
+		}
+	}
 	defer func() {
 		if errRec := recover(); errRec != nil {
+			if ha, ok := errRec.(hookAbort); ok {
+				errRec = ha.v
+			}
 			if _, ok := errRec.(error); ok {
 				err = errRec.(error)
 			}
+			if le, ok := err.(*LuaError); ok && L.memoryLimitHit() {
+				// the message handler failed to allocate the error
+				le.Code, le.memoryLimitHit = LUA_ERRMEM, true
+			}
+			main.errorValue, main.errorGo = nil, nil
+			setFailed()
 			return
 		}
 	}()
 
+	if main.hookAborted {
+		L.Pop(nargs + 1)
+		return errHookAborted
+	}
+
+	L.r.Lock()
+	L.releaseDeadRefs()
+	L.r.Unlock()
+
 	L.GetGlobal(C.GOLUA_DEFAULT_MSGHANDLER)
 	// We must record where we put the error handler in the stack otherwise it will be impossible to remove after the pcall when nresults == LUA_MULTRET
 	erridx := L.GetTop() - nargs - 1
 	L.Insert(erridx)
+	L.memoryLimitHit()
 	r := L.pcall(nargs, nresults, erridx)
 	L.Remove(erridx)
 	if r != 0 {
+		if err := L.hookAbortError(); err != nil {
+			main.errorValue, main.errorGo = nil, nil
+			setFailed()
+			return err
+		}
+		limitHit := L.memoryLimitHit()
+		if limitHit {
+			r = LUA_ERRMEM
+		}
 		le := &LuaError{}
 		if err := le.Parse(L.ToString(-1)); err != nil {
 			le = le.New(L, r, L.ToString(-1))
@@ -201,7 +270,44 @@ func (L *State) callEx(nargs, nresults int) (err error) {
 		} else {
 			le.Code = r
 		}
+		le.memoryLimitHit = limitHit
+		le.err, main.errorGo = main.errorGo, nil
+		le.value, main.errorValue = main.errorValue, nil
+		if le.value != nil {
+			le.value.Push()
+			if raised := L.toRaisedError(-1); raised != nil {
+				// a Go error raised by a go function, see RaiseGoError
+				le.err, le.value = raised.err, nil
+			}
+			L.Pop(1)
+		}
+		setFailed()
 		return le
 	}
 	return nil
 }
+
+// Calls the function below the arguments args, pushed with PushGoValue, and
+// returns its results converted with ToValue into interface{} values, or
+// into a Value when they can't be converted.
+// The stack is left as it was before the function was pushed.
+func (L *State) callValues(args []interface{}) ([]interface{}, error) {
+	top := L.GetTop() - 1
+	defer L.SetTop(top)
+	for i, arg := range args {
+		if err := L.PushGoValue(arg); err != nil {
+			return nil, fmt.Errorf("lua: argument #%d: %v", i+1, err)
+		}
+	}
+	if err := L.callEx(len(args), LUA_MULTRET); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, L.GetTop()-top)
+	for i := range results {
+		if err := L.ToValue(top+i+1, &results[i]); err != nil {
+			// functions, coroutines and the tables holding them
+			results[i] = L.toLuaValue(top + i + 1)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,266 @@
+package lua
+
+/*
+#cgo CFLAGS: -I ${SRCDIR} -I ${SRCDIR}/lua
+
+#include "golua.h"
+
+*/
+import "C"
+
+import (
+	"errors"
+	"reflect"
+)
+
+// A lua value seen from Go, returned by the Table methods.
+//
+// nil, booleans, strings and numbers (float64) are returned as Go values,
+// the int64 and uint64 cdata as int64 and uint64, the user data of Go objects
+// (see PushGoStruct and RegisterType) as the objects, the tables as *Table,
+// the functions as *Function and the other values (coroutines, ...) as *Ref.
+// The *Table, *Function and *Ref values have a finalizer (see Ref.SetFinalizer)
+// and may be released earlier with Release.
+type Value interface{}
+
+// A lua table held through a registry reference.
+//
+// The methods leave the stack of the state unchanged. Like the lua API Get and
+// Set call the metamethods of the table, RawGet and RawSet don't. Keys and
+// values are converted with PushGoValue. The accesses run in protected mode,
+// the errors of the metamethods are returned as *LuaError, and Set and RawSet
+// return an error for the nil and NaN keys.
+type Table struct {
+	*Ref
+}
+
+var (
+	typeOfRef   = reflect.TypeOf((*Ref)(nil))
+	typeOfTable = reflect.TypeOf((*Table)(nil))
+
+	errTableReleased = errors.New("lua: table has been released")
+)
+
+// Returns a Table referencing the table at index, nil if the value isn't a table
+func (L *State) ToTable(index int) *Table {
+	if !L.IsTable(index) {
+		return nil
+	}
+	return &Table{L.NewRef(index)}
+}
+
+// Returns the table of the globals
+func (L *State) Globals() *Table {
+	L.PushValue(LUA_GLOBALSINDEX)
+	defer L.Pop(1)
+	return L.ToTable(-1)
+}
+
+// t[key]
+func (t *Table) Get(key interface{}) (Value, error) {
+	return t.get(key, tableGet)
+}
+
+// t[key] = val
+func (t *Table) Set(key, val interface{}) error {
+	return t.set(key, val, tableSet)
+}
+
+// Like Get without calling the metamethods
+func (t *Table) RawGet(key interface{}) (Value, error) {
+	return t.get(key, tableRawGet)
+}
+
+// Like Set without calling the metamethods
+func (t *Table) RawSet(key, val interface{}) error {
+	return t.set(key, val, tableRawSet)
+}
+
+// Returns the length of the table (the # operator)
+func (t *Table) Len() int {
+	L := t.L
+	defer L.r.Unlock()
+	L.r.Lock()
+	if t.released() {
+		return 0
+	}
+	t.Push()
+	defer L.Pop(1)
+	return int(L.ObjLen(-1))
+}
+
+// Sets t[#t + 1] to v, without calling the metamethods
+func (t *Table) Append(v interface{}) error {
+	L := t.L
+	defer L.r.Unlock()
+	L.r.Lock()
+	if t.released() {
+		return errTableReleased
+	}
+	t.Push()
+	defer L.Pop(1)
+	n := int(L.ObjLen(-1))
+	if err := L.PushGoValue(v); err != nil {
+		return err
+	}
+	L.RawSeti(-2, n+1)
+	return nil
+}
+
+// Returns the keys of the table, in the order of next
+func (t *Table) Keys() []Value {
+	var keys []Value
+	t.ForEach(func(k, v Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+// Calls f for each key and value of the table, in the order of next,
+// until f returns false. f must not add keys to the table.
+func (t *Table) ForEach(f func(k, v Value) bool) {
+	L := t.L
+	defer L.r.Unlock()
+	L.r.Lock()
+	if t.released() {
+		return
+	}
+	top := L.GetTop()
+	defer L.SetTop(top)
+	t.Push()
+	L.PushNil()
+	for L.Next(top+1) != 0 {
+		if !f(L.toLuaValue(-2), L.toLuaValue(-1)) {
+			return
+		}
+		L.Pop(1)
+	}
+}
+
+// the table accesses of clua_pushtableaccess
+const (
+	tableGet = iota
+	tableSet
+	tableRawGet
+	tableRawSet
+)
+
+// does the access op to the table in a protected call, see clua_pushtableaccess
+func (t *Table) get(key interface{}, op int) (Value, error) {
+	L := t.L
+	defer L.r.Unlock()
+	L.r.Lock()
+	if t.released() {
+		return nil, errTableReleased
+	}
+	top := L.GetTop()
+	defer L.SetTop(top)
+	C.clua_pushtableaccess(L.s, C.int(op))
+	t.Push()
+	if err := L.PushGoValue(key); err != nil {
+		return nil, err
+	}
+	if err := L.callInternal(2, 1); err != nil {
+		return nil, err
+	}
+	return L.toLuaValue(-1), nil
+}
+
+func (t *Table) set(key, val interface{}, op int) error {
+	L := t.L
+	defer L.r.Unlock()
+	L.r.Lock()
+	if t.released() {
+		return errTableReleased
+	}
+	top := L.GetTop()
+	defer L.SetTop(top)
+	C.clua_pushtableaccess(L.s, C.int(op))
+	t.Push()
+	if err := L.PushGoValue(key); err != nil {
+		return err
+	}
+	if L.IsNil(-1) {
+		return errors.New("lua: table index is nil")
+	}
+	if n := L.ToNumber(-1); L.Type(-1) == LUA_TNUMBER && n != n {
+		return errors.New("lua: table index is NaN")
+	}
+	if err := L.PushGoValue(val); err != nil {
+		return err
+	}
+	return L.callInternal(3, 0)
+}
+
+// replaces the table on top of the stack by table[field], calling the
+// metamethods in a protected call. The table is popped on errors.
+func (L *State) getFieldEx(field string) error {
+	C.clua_pushtableaccess(L.s, C.int(tableGet))
+	L.Insert(-2)
+	L.PushString(field)
+	return L.callInternal(2, 1)
+}
+
+// converts the value at index into a Value, see Value
+func (L *State) toLuaValue(index int) Value {
+	switch L.Type(index) {
+	case LUA_TNIL, LUA_TNONE:
+		return nil
+	case LUA_TBOOLEAN:
+		return L.ToBoolean(index)
+	case LUA_TNUMBER:
+		return L.ToNumber(index)
+	case LUA_TSTRING:
+		return L.ToString(index)
+	case LUA_TTABLE:
+		t := L.ToTable(index)
+		t.SetFinalizer()
+		return t
+	case LUA_TFUNCTION:
+		f := L.ToFunction(index)
+		f.SetFinalizer()
+		return f
+	case LUA_TCDATA:
+		switch L.LuaJITctypeID(index) {
+		case ctidInt64:
+			return L.CdataToInt64(index)
+		case ctidUint64:
+			return L.CdataToUint64(index)
+		}
+	case LUA_TUSERDATA:
+		if obj, ok := L.toGoObject(index); ok {
+			return obj
+		}
+	}
+	return L.NewRef(index).SetFinalizer()
+}
+
+// pushes the value referenced by a *Ref, *Table or *Function, ok is false for the other values
+func (L *State) pushRefValue(v reflect.Value) (ok bool, err error) {
+	if t := v.Type(); (t != typeOfRef && t != typeOfTable && t != typeOfFunction) || !v.CanInterface() {
+		return false, nil
+	}
+	var r *Ref
+	switch x := v.Interface().(type) {
+	case *Ref:
+		r = x
+	case *Table:
+		if x != nil {
+			r = x.Ref
+		}
+	case *Function:
+		if x != nil {
+			r = x.Ref
+		}
+	}
+	if r == nil {
+		L.PushNil()
+		return true, nil
+	}
+	if r.L.MainCo != L.MainCo {
+		return true, errors.New("lua: cannot push a reference of another state")
+	}
+	r.PushTo(L)
+	return true, nil
+}
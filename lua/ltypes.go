@@ -200,6 +200,17 @@ func (L *State) ToGoStruct(index int) (f interface{}) {
 	return L.Shared.registry[fid]
 }
 
+// Returns the error raised by the assignments to the Go struct user data at
+// index 1, "" unless it is a read-only proxy over a copy (see pushProxyValue)
+func (L *State) proxyReadOnly() string {
+	if !L.IsGoStruct(1) {
+		return ""
+	}
+	defer L.r.Unlock()
+	L.r.Lock()
+	return L.Shared.readOnly[uint(C.clua_togostruct(L.s, 1))]
+}
+
 // lua_tostring
 func (L *State) ToString(index int) string {
 	var size C.size_t
@@ -224,8 +235,19 @@ func (L *State) ToPointer(index int) uintptr {
 	return uintptr(C.lua_topointer(L.s, C.int(index)))
 }
 
-// lua_tothread
+// lua_tothread, the coroutine is anchored like with NewThread until its Release
 func (L *State) ToThread(index int) *State {
+	defer L.r.Unlock()
+	L.r.Lock()
+	L1 := L.toThread(index)
+	if L1 != nil {
+		L.anchorThread(index, L1)
+	}
+	return L1
+}
+
+// like ToThread without anchoring the coroutine
+func (L *State) toThread(index int) *State {
 	defer L.r.Unlock()
 	L.r.Lock()
 	ptr := (*C.lua_State)(unsafe.Pointer(C.lua_tothread(L.s, C.int(index))))
@@ -235,6 +257,33 @@ func (L *State) ToThread(index int) *State {
 	return L.ToThreadHelper(ptr)
 }
 
+// Anchors the coroutine L1 at index in the registry until its Release: the
+// wrappers of the coroutines returned to Go can't outlive them, the other
+// ones are released after their collection (see AllCoro)
+func (L *State) anchorThread(index int, L1 *State) {
+	if L1.anchor != 0 || L1 == L1.MainCo {
+		return
+	}
+	L.PushValue(index)
+	L1.anchor = L.Ref(LUA_REGISTRYINDEX)
+}
+
+// Releases the anchor of the coroutine L taken by NewThread or ToThread, lua
+// can then collect it once it is unreachable and L must not be used after
+// that. Release does nothing on the main coroutine and can be called more
+// than once, a later ToThread anchors the coroutine again.
+func (L *State) Release() {
+	defer L.r.Unlock()
+	L.r.Lock()
+	if L.anchor == 0 {
+		return
+	}
+	if !L.MainCo.closed {
+		L.MainCo.Unref(LUA_REGISTRYINDEX, L.anchor)
+	}
+	L.anchor = 0
+}
+
 func (L *State) ToThreadHelper(ptr *C.lua_State) *State {
 	if ptr == nil {
 		return nil
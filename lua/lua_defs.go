@@ -20,6 +20,7 @@ const (
 	LUA_TUSERDATA      = LuaValType(C.LUA_TUSERDATA)
 	LUA_TTHREAD        = LuaValType(C.LUA_TTHREAD)
 	LUA_TLIGHTUSERDATA = LuaValType(C.LUA_TLIGHTUSERDATA)
+	LUA_TCDATA         = LuaValType(C.LUA_TCDATA)
 )
 
 const (
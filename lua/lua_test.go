@@ -1,8 +1,15 @@
 package lua
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 	"unsafe"
 )
 
@@ -79,45 +86,57 @@ func TestCheckStringFail(t *testing.T) {
 	}
 }
 
-// jea: works under OpenLibs, because generally
-//      we will need pcall/xpcall.
-//
-// See https://github.com/vxcontrol/golua#on-error-handling
-//   for why they are hidden. We should probably
-//   be hiding these then using unsafe_pcall, and
-//   verify that Lua code using them doesn't call
-//   back into Go code that panics.
-/*
-Shortened version of the on-error-handling link:
-
-Lua's exceptions are incompatible with Go.
-golua works around this incompatibility by
-setting up protected execution environments
-in lua.State.DoString, lua.State.DoFile, and
-lua.State.Call and turning every exception
-into a Go panic.
-
-This means that:
-
-In general you can't do any exception handling
-from Lua, pcall and xpcall are renamed to
-unsafe_pcall and unsafe_xpcall. They are only
-safe to be called from Lua code that never
-calls back to Go. Use at your own risk.
-*/
-func TestPCallHidden(t *testing.T) {
+func TestPCall(t *testing.T) {
 	L := NewState()
 	L.OpenLibs()
 	defer L.Close()
 
-	err := L.DoString("pcall(print, \"ciao\")")
-	if err == nil {
-		t.Fatal("Can use pcall\n")
-	}
+	L.Register("fail", func(L *State) int {
+		L.RaiseError("failed in go: " + L.CheckString(1))
+		return 0
+	})
+	L.Register("callback", func(L *State) int {
+		L.CheckType(1, LUA_TFUNCTION)
+		if err := L.Call(0, 0); err != nil {
+			L.RaiseError(err.(*LuaError).Msg)
+		}
+		return 0
+	})
 
-	err = L.DoString("unsafe_pcall(print, \"ciao\")")
+	err := L.DoString(`
+		for i = 1, 100 do
+			local ok, msg = pcall(fail, "x")
+			assert(not ok and msg == "failed in go: x", msg)
+		end
+		local ok, msg = xpcall(function() fail("y") end, function(m) return "handled: " .. m end)
+		assert(not ok and msg == "handled: failed in go: y", msg)
+		ok, msg = pcall(callback, function() error("from lua", 0) end)
+		assert(not ok and msg == "from lua", msg)
+		ok, msg = pcall(callback, function() fail("z") end)
+		assert(not ok and msg == "failed in go: z", msg)
+		ok, msg = pcall(fail, {})
+		assert(not ok and msg:find("bad argument #1"), msg)
+		assert(unsafe_pcall == pcall and unsafe_xpcall == xpcall)
+	`)
 	if err != nil {
-		t.Fatal("Can not use unsafe_pcall\n")
+		t.Fatalf("pcall failed: %v", err)
+	}
+	if L.GetTop() != 0 {
+		t.Fatalf("Stack not empty: %d", L.GetTop())
+	}
+
+	// uncaught errors keep the go stack trace of RaiseError
+	err = L.DoString(`fail("w")`)
+	le, ok := err.(*LuaError)
+	if !ok || le.Msg != "failed in go: w" || len(le.GoST) < 2 || !strings.HasSuffix(le.GoST[1].Name, "TestPCall.func1") {
+		t.Fatalf("Wrong error: %#v", err)
+	}
+
+	// errors of hooks can't be caught
+	L.SetExecutionLimit(1000)
+	err = L.DoString(`pcall(function() while true do end end) error("not reached")`)
+	if err == nil || err.(*LuaError).Msg != ExecutionQuantumExceeded {
+		t.Fatalf("Expected the execution limit error, got: %v", err)
 	}
 }
 
@@ -863,3 +882,1802 @@ func TestToThreadDeduplicatesCoroutines(t *testing.T) {
 	assert(t, thr4.AllCoro == nil, "non-main coroutines should have nil AllCoro maps")
 	assert(t, L2.AllCoro[thr4.Upos] == thr4, "thr4 should be found in L2's AllCoro, at Upos")
 }
+
+func TestCoroutineCollection(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	// go sees the coroutines through the calls
+	L.Register("touch", func(L *State) int { return 0 })
+	err := L.DoString(`
+		kept = coroutine.create(function() touch(); coroutine.yield() end)
+		coroutine.resume(kept)
+		for i = 1, 100 do
+			coroutine.wrap(function() touch() end)()
+		end
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	if n := len(L.AllCoro); n < 102 {
+		t.Fatalf("expected at least 102 coroutines known by go, got %d", n)
+	}
+
+	L.GC(LUA_GCCOLLECT, 0)
+	L.GC(LUA_GCCOLLECT, 0)
+	if n := L.CollectedCoroutines(); n < 100 {
+		t.Fatalf("expected at least 100 collected coroutines, got %d", n)
+	}
+	if n := len(L.AllCoro); n != 2 {
+		t.Fatalf("expected the main coroutine and kept in AllCoro, got %d", n)
+	}
+
+	err = L.DoString(`
+		assert(coroutine.resume(kept))
+		assert(coroutine.status(kept) == "dead")
+		local co = coroutine.wrap(function() touch(); coroutine.yield(1); return 2 end)
+		assert(co() == 1 and co() == 2)
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	// the coroutines returned to go are not collected
+	co := L.NewThread()
+	L.Pop(1)
+	if err := L.DoString(`returned = coroutine.create(function() end)`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	L.GetGlobal("returned")
+	co2 := L.ToThread(-1)
+	L.Pop(1)
+	L.PushNil()
+	L.SetGlobal("returned")
+	for i := 0; i < 3; i++ {
+		L.GC(LUA_GCCOLLECT, 0)
+	}
+	for _, c := range []*State{co, co2} {
+		c.GetGlobal("print")
+		if !c.IsFunction(-1) {
+			t.Fatalf("Wrong global in a coroutine returned to go: %s", c.LTypename(-1))
+		}
+		c.Pop(1)
+		if L.AllCoro[c.Upos] != c {
+			t.Fatal("Coroutine returned to go removed from AllCoro")
+		}
+	}
+
+	// until their release
+	collected := L.CollectedCoroutines()
+	co.Release()
+	co2.Release()
+	for i := 0; i < 100; i++ {
+		L.NewThread().Release()
+		L.Pop(1)
+	}
+	for i := 0; i < 3; i++ {
+		L.GC(LUA_GCCOLLECT, 0)
+	}
+	if n := L.CollectedCoroutines() - collected; n != 102 {
+		t.Fatalf("expected 102 released coroutines collected, got %d", n)
+	}
+	if n := len(L.AllCoro); n != 2 {
+		t.Fatalf("expected the main coroutine and kept in AllCoro, got %d", n)
+	}
+}
+
+type convInner struct {
+	Port  int
+	Hosts []string
+}
+
+type convStruct struct {
+	Name    string            `lua:"name"`
+	Skipped string            `lua:"-"`
+	Empty   string            `lua:"empty,omitempty"`
+	Ratio   float64           `lua:"ratio"`
+	Inner   *convInner        `lua:"inner"`
+	Limits  map[string]uint16 `lua:"limits"`
+	Flags   [2]bool           `lua:"flags"`
+	hidden  int
+}
+
+func TestPushGoValueToValue(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	in := convStruct{
+		Name:    "srv",
+		Skipped: "x",
+		Ratio:   0.5,
+		Inner:   &convInner{Port: 8080, Hosts: []string{"a", "b"}},
+		Limits:  map[string]uint16{"cpu": 2},
+		Flags:   [2]bool{true, false},
+	}
+	if err := L.PushGoValue(in); err != nil {
+		t.Fatalf("PushGoValue failed: %v", err)
+	}
+	L.SetGlobal("v")
+
+	err := L.DoString(`
+		assert(v.name == "srv")
+		assert(v.Skipped == nil and v.empty == nil and v.hidden == nil)
+		assert(v.inner.Port == 8080 and #v.inner.Hosts == 2 and v.inner.Hosts[2] == "b")
+		assert(v.limits.cpu == 2 and v.flags[1] == true)
+		v.inner.Port = 9090
+		v.limits.mem = 512
+		v.empty = "set"
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	L.GetGlobal("v")
+	var out convStruct
+	if err := L.ToValue(-1, &out); err != nil {
+		t.Fatalf("ToValue failed: %v", err)
+	}
+	if L.GetTop() != 1 {
+		t.Fatalf("ToValue did not keep the stack balanced: %d", L.GetTop())
+	}
+	L.Pop(1)
+	if out.Name != "srv" || out.Empty != "set" || out.Ratio != 0.5 || out.Inner.Port != 9090 ||
+		out.Limits["mem"] != 512 || out.Inner.Hosts[0] != "a" || !out.Flags[0] {
+		t.Fatalf("Wrong conversion result: %+v %+v", out, out.Inner)
+	}
+	top := L.GetTop()
+	if err := L.PushGoValue(map[float64]int{1: 1, math.NaN(): 2}); err == nil {
+		t.Fatal("PushGoValue should fail on a NaN map key")
+	}
+	if err := L.PushGoValue(map[*int]int{nil: 1}); err == nil {
+		t.Fatal("PushGoValue should fail on a nil map key")
+	}
+	if L.GetTop() != top {
+		t.Fatalf("a failed PushGoValue should leave the stack unchanged: %d", L.GetTop())
+	}
+
+	if err := L.DoString(`return {1, "two", {x = true}}`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	var any interface{}
+	if err := L.ToValue(-1, &any); err != nil {
+		t.Fatalf("ToValue failed: %v", err)
+	}
+	L.Pop(1)
+	arr, ok := any.([]interface{})
+	if !ok || len(arr) != 3 || arr[0] != 1.0 || arr[1] != "two" || arr[2].(map[string]interface{})["x"] != true {
+		t.Fatalf("Wrong conversion into interface{}: %#v", any)
+	}
+
+	var n int8
+	L.PushNumber(1.5)
+	if err := L.ToValue(-1, &n); err == nil {
+		t.Fatal("Converting 1.5 into int8 should fail")
+	}
+	L.PushInteger(300)
+	if err := L.ToValue(-1, &n); err == nil {
+		t.Fatal("Converting 300 into int8 should fail")
+	}
+	L.Pop(2)
+
+	if err := L.PushGoValue(make(chan int)); err == nil {
+		t.Fatal("Pushing a channel should fail")
+	}
+	if L.GetTop() != 0 {
+		t.Fatal("Failed PushGoValue left values on the stack")
+	}
+}
+
+func TestPushGoValueCycles(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	type node struct {
+		Name string
+		Next *node
+	}
+	a := &node{Name: "a"}
+	a.Next = &node{Name: "b", Next: a}
+	if err := L.PushGoValue(a); err != nil {
+		t.Fatalf("PushGoValue failed: %v", err)
+	}
+	L.SetGlobal("a")
+	if err := L.DoString(`assert(a.Next.Next == a and a.Next.Name == "b")`); err != nil {
+		t.Fatalf("Cycle was not preserved: %v", err)
+	}
+
+	if err := L.DoString(`local t = {} t.self = t return t`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	var m map[string]interface{}
+	if err := L.ToValue(-1, &m); err == nil {
+		t.Fatal("Converting a cyclic table should fail")
+	}
+}
+
+type methodStruct struct {
+	Count int
+}
+
+func (m *methodStruct) Add(n int) int {
+	m.Count += n
+	return m.Count
+}
+
+func (m methodStruct) Describe(prefix string, names ...string) (string, int) {
+	return fmt.Sprintf("%s%d:%d", prefix, m.Count, len(names)), len(names)
+}
+
+func (m *methodStruct) Merge(o *methodStruct) int {
+	return m.Count + o.Count
+}
+
+func (m *methodStruct) Fail(msg string) error {
+	if msg != "" {
+		return fmt.Errorf("failed: %s", msg)
+	}
+	return nil
+}
+
+func TestGoStructMethods(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	m := &methodStruct{}
+	L.PushGoStruct(m)
+	L.SetGlobal("m")
+
+	err := L.DoString(`
+		assert(m:Add(2) == 2)
+		assert(m.Add(3) == 5)
+		local s, n = m:Describe("c", "a", "b")
+		assert(s == "c5:2" and n == 2)
+		assert(m:Fail("") == nil)
+		assert(m.Missing == nil)
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if m.Count != 5 {
+		t.Fatalf("Method did not modify the receiver: %d", m.Count)
+	}
+
+	L.PushGoStruct(&methodStruct{Count: 10})
+	L.SetGlobal("other")
+	err = L.DoString(`
+		assert(m:Merge(other) == 15)
+		assert(m.Merge(other) == 15)
+		assert(other:Merge(m) == 15)
+	`)
+	if err != nil {
+		t.Fatalf("A second object of the same type was not passed: %v", err)
+	}
+
+	err = L.DoString(`m:Fail("boom")`)
+	if err == nil || err.(*LuaError).Msg != "failed: boom" {
+		t.Fatalf("Trailing error was not raised: %v", err)
+	}
+
+	err = L.DoString(`m:Add("x")`)
+	if err == nil || !strings.Contains(err.(*LuaError).Msg, "bad argument #1 to 'Add'") {
+		t.Fatalf("Bad argument was not reported: %v", err)
+	}
+}
+
+type nestedServer struct {
+	Host string
+	Port int
+}
+
+type nestedConfig struct {
+	Server  nestedServer
+	Backup  *nestedServer
+	Tags    []string
+	Limits  map[string]int
+	Matrix  [2][2]int
+	Servers map[string]*nestedServer
+	Values  map[string]nestedServer
+	Format  func(string, int) string
+}
+
+func TestGoStructNestedFields(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	cfg := &nestedConfig{
+		Server:  nestedServer{"localhost", 80},
+		Backup:  &nestedServer{"backup", 81},
+		Tags:    []string{"a", "b", "c"},
+		Limits:  map[string]int{"cpu": 1},
+		Servers: map[string]*nestedServer{"x": {"x", 1}},
+		Values:  map[string]nestedServer{"x": {"x", 1}},
+		Format:  func(s string, n int) string { return fmt.Sprintf("%s=%d", s, n) },
+	}
+	L.PushGoStruct(cfg)
+	L.SetGlobal("cfg")
+
+	err := L.DoString(`
+		assert(cfg.Server.Port == 80 and cfg.Backup.Host == "backup")
+		assert(cfg.Tags[2] == "b" and cfg.Tags[4] == nil and #cfg.Tags == 3)
+		cfg.Server.Port = 8080
+		cfg.Backup.Port = 8181
+		cfg.Tags[2] = "B"
+		cfg.Tags[4] = "d"
+		cfg.Limits["cpu"] = 2
+		cfg.Limits.mem = 512
+		cfg.Matrix[2][1] = 7
+		cfg.Servers.x.Port = 2
+
+		local n = 0
+		for i, v in ipairs(cfg.Tags) do
+			assert(i == n + 1)
+			n = i
+		end
+		assert(n == 4)
+
+		local keys = 0
+		for k, v in pairs(cfg.Limits) do
+			keys = keys + 1
+			assert(cfg.Limits[k] == v)
+		end
+		assert(keys == 2 and #cfg.Limits == 2)
+
+		local fields = {}
+		for k, v in pairs(cfg.Server) do
+			fields[k] = v
+		end
+		assert(fields.Host == "localhost" and fields.Port == 8080)
+
+		cfg.Limits.cpu = nil
+		cfg.Tags = {"z"}
+		assert(cfg.Format("k", 3) == "k=3")
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	if cfg.Server.Port != 8080 || cfg.Backup.Port != 8181 || cfg.Matrix[1][0] != 7 || cfg.Servers["x"].Port != 2 {
+		t.Fatalf("Nested struct fields were not updated: %+v", cfg)
+	}
+	if len(cfg.Tags) != 1 || cfg.Tags[0] != "z" {
+		t.Fatalf("Slice field was not assigned: %v", cfg.Tags)
+	}
+	if _, ok := cfg.Limits["cpu"]; ok || cfg.Limits["mem"] != 512 {
+		t.Fatalf("Map field was not updated: %v", cfg.Limits)
+	}
+
+	if err := L.DoString(`cfg.Tags[5] = "x"`); err == nil {
+		t.Fatal("Assignment out of range should fail")
+	}
+	if err := L.DoString(`cfg.Limits.cpu = "x"`); err == nil {
+		t.Fatal("Wrong map value type should fail")
+	}
+
+	// the struct elements of maps are copies, they can only be replaced
+	err = L.DoString(`cfg.Values.x.Port = 2`)
+	if err == nil || !strings.Contains(err.Error(), "cannot assign to map element") {
+		t.Fatalf("Assignment to a map element should fail: %v", err)
+	}
+	if err := L.DoString(`
+		assert(cfg.Values.x.Port == 1)
+		for k, v in pairs(cfg.Values) do
+			assert(not pcall(function() v.Port = 2 end))
+		end
+		cfg.Values.y = {Host = "y", Port = 3}
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if cfg.Values["x"].Port != 1 || cfg.Values["y"].Port != 3 {
+		t.Fatalf("Map elements were not replaced: %v", cfg.Values)
+	}
+}
+
+type vec2 struct {
+	X, Y float64
+}
+
+func (v *vec2) LuaAdd(o *vec2) *vec2   { return &vec2{v.X + o.X, v.Y + o.Y} }
+func (v *vec2) LuaMul(k float64) *vec2 { return &vec2{v.X * k, v.Y * k} }
+func (v *vec2) LuaDiv(k float64) *vec2 { return &vec2{v.X / k, v.Y / k} }
+func (v *vec2) LuaUnm() *vec2          { return &vec2{-v.X, -v.Y} }
+func (v *vec2) LuaEq(o *vec2) bool     { return v.X == o.X && v.Y == o.Y }
+func (v *vec2) LuaLt(o *vec2) bool     { return v.Len2() < o.Len2() }
+func (v *vec2) LuaLen() float64        { return v.Len2() }
+func (v *vec2) LuaString() string      { return fmt.Sprintf("(%g, %g)", v.X, v.Y) }
+func (v *vec2) Len2() float64          { return v.X*v.X + v.Y*v.Y }
+func (v *vec2) Scale(k float64)        { v.X, v.Y = v.X*k, v.Y*k }
+
+func (v *vec2) LuaConcat(o string, right bool) string {
+	if right {
+		return o + v.LuaString()
+	}
+	return v.LuaString() + o
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestRegisterType(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	err := L.RegisterType("vec2", &vec2{}, WithConstructor("Vec2", func(x, y float64) *vec2 {
+		return &vec2{x, y}
+	}))
+	if err != nil {
+		t.Fatalf("RegisterType failed: %v", err)
+	}
+	if err := L.RegisterType("vec2bis", &vec2{}); err == nil {
+		t.Fatal("Registering the same type twice should fail")
+	}
+	if err := L.RegisterType("point", &point{}, WithConstructor("Point", 1)); err == nil {
+		t.Fatal("A constructor which isn't a function should fail")
+	}
+	if err := L.RegisterType("point", &point{}); err != nil {
+		t.Fatalf("A failed RegisterType should not leave the type registered: %v", err)
+	}
+
+	length := func(L *State) int {
+		v := CheckUserdataOf[*vec2](L, 1)
+		L.PushNumber(v.Len2())
+		return 1
+	}
+	L.Register("len2", length)
+
+	err = L.DoString(`
+		local a, b = Vec2(1, 2), Vec2(3, 4)
+		local c = a + b
+		assert(c.X == 4 and c.Y == 6)
+		assert(tostring(a * 2) == "(2, 4)")
+		assert(tostring(-a) == "(-1, -2)")
+		assert(a == Vec2(1, 2) and a ~= b)
+		assert(a < b and not (b < a))
+		assert(#b == 25 and len2(b) == 25)
+		assert(a .. "!" == "(1, 2)!" and "a = " .. a == "a = (1, 2)")
+		assert(tostring(b / 2) == "(1.5, 2)")
+		a:Scale(10)
+		a.Y = 5
+		assert(a.X == 10 and a.Y == 5)
+		result = a
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	L.GetGlobal("result")
+	v, ok := ToUserdataOf[*vec2](L, -1)
+	if !ok || v.X != 10 || v.Y != 5 {
+		t.Fatalf("Wrong object returned: %v %v", v, ok)
+	}
+	var v2 *vec2
+	if err := L.ToValue(-1, &v2); err != nil || v2 != v {
+		t.Fatalf("ToValue did not return the wrapped object: %v", err)
+	}
+	L.Pop(1)
+
+	if err := L.PushGoValue(&vec2{7, 8}); err != nil {
+		t.Fatalf("PushGoValue failed: %v", err)
+	}
+	L.SetGlobal("pushed")
+	if err := L.DoString(`assert(tostring(pushed) == "(7, 8)")`); err != nil {
+		t.Fatalf("PushGoValue did not push a typed object: %v", err)
+	}
+
+	err = L.DoString(`len2({})`)
+	if err == nil || !strings.Contains(err.(*LuaError).Msg, "bad argument #1 (vec2 expected, got table)") {
+		t.Fatalf("CheckUserdataOf did not raise the expected error: %v", err)
+	}
+}
+
+func TestCheckOption(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	modes := []string{"read", "write", "append"}
+	L.Register("mode", func(L *State) int {
+		L.PushInteger(int64(L.CheckOption(1, "read", modes)))
+		return 1
+	})
+	L.Register("strict", func(L *State) int {
+		L.PushInteger(int64(L.CheckOption(1, "", modes)))
+		return 1
+	})
+
+	if err := L.DoString(`assert(mode() == 0 and mode("append") == 2 and strict("write") == 1)`); err != nil {
+		t.Fatalf("CheckOption returned wrong values: %v", err)
+	}
+
+	err := L.DoString(`mode("delete")`)
+	if err == nil || err.(*LuaError).Msg != "bad argument #1 (invalid option 'delete')" {
+		t.Fatalf("Invalid option was not reported: %v", err)
+	}
+	if err := L.DoString(`strict()`); err == nil {
+		t.Fatal("Missing mandatory option was not reported")
+	}
+}
+
+func TestDoStringContext(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := L.DoStringContext(ctx, `while true do end`)
+	var ce *ContextError
+	if !errors.As(err, &ce) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got: %v", err)
+	}
+	if len(L.hooks) != 0 {
+		t.Fatal("The context hook was not removed")
+	}
+	L.SetTop(0)
+
+	// the state is still usable and pcall or coroutines can't catch the abort
+	for _, code := range []string{
+		`while true do end`,
+		`while true do pcall(function() while true do end end) end`,
+		`while true do coroutine.resume(coroutine.create(function() while true do end end)) end`,
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := L.DoStringContext(ctx, code)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected a deadline error for %s, got: %v", code, err)
+		}
+		L.SetTop(0)
+	}
+	if err := L.DoString(`x = 0 for i = 1, 10 do x = x + i end`); err != nil {
+		t.Fatalf("DoString failed after an abort: %v", err)
+	}
+	L.GetGlobal("x")
+	if L.ToInteger(-1) != 55 {
+		t.Fatalf("Wrong result after an abort: %v", L.ToInteger(-1))
+	}
+	L.Pop(1)
+
+	// the previous hook is restored
+	L = NewState()
+	L.OpenLibs()
+	defer L.Close()
+	L.SetExecutionLimit(1000)
+	if err := L.DoStringContext(context.Background(), `x = 1`); err != nil {
+		t.Fatalf("DoStringContext failed: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := L.DoStringContext(ctx, `y = 1`); err != nil {
+		t.Fatalf("DoStringContext failed: %v", err)
+	}
+	cancel()
+	if err := L.DoStringContext(ctx, `z = 1`); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a canceled error, got: %v", err)
+	}
+	if L.GetTop() != 0 {
+		t.Fatalf("Stack not empty: %d", L.GetTop())
+	}
+	err = L.DoString(`while true do end`)
+	if err == nil || err.(*LuaError).Msg != ExecutionQuantumExceeded {
+		t.Fatalf("The execution limit was not restored: %v", err)
+	}
+}
+
+func TestSetHookMask(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	var lines []int
+	calls := map[string]int{}
+	L.SetHookMask(func(L *State, ev HookEvent) {
+		switch ev.Event {
+		case LUA_HOOKLINE:
+			if ev.Source == "=hooked" {
+				lines = append(lines, ev.CurrentLine)
+			}
+		case LUA_HOOKCALL:
+			if ev.What == "Lua" {
+				calls[ev.Name+" "+ev.NameWhat+" "+ev.ShortSrc]++
+			}
+		}
+	}, LUA_MASKLINE|LUA_MASKCALL, 0)
+
+	code := "local function f(x)\n  return x + 1\nend\nlocal y = f(1)\ny = f(y)\n"
+	if L.LoadBuffer([]byte(code), len(code), "=hooked") != 0 {
+		t.Fatalf("LoadBuffer failed: %s", L.ToString(-1))
+	}
+	if err := L.Call(0, 0); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if fmt.Sprint(lines) != "[3 4 2 5 2 5]" {
+		t.Fatalf("Wrong lines: %v", lines)
+	}
+	if calls["f local hooked"] != 2 {
+		t.Fatalf("Wrong calls: %v", calls)
+	}
+
+	// the execution limit and the other hooks are chained with the user hook
+	count := 0
+	L.SetHookMask(func(L *State, ev HookEvent) {
+		if ev.Event != LUA_HOOKCOUNT {
+			t.Fatalf("Unexpected event %d", ev.Event)
+		}
+		count++
+	}, 0, 100)
+	added := 0
+	id := L.AddHook(func(L *State, ev HookEvent) { added++ }, LUA_MASKCOUNT, 300)
+	L.SetExecutionLimit(1000)
+	err := L.DoString(`while true do end`)
+	if err == nil || err.(*LuaError).Msg != ExecutionQuantumExceeded {
+		t.Fatalf("Expected the execution limit error, got: %v", err)
+	}
+	if count != 10 || added != 3 {
+		t.Fatalf("Wrong number of hook calls: %d %d", count, added)
+	}
+
+	// the hooks are still called after the abort
+	count, added = 0, 0
+	L.SetTop(0)
+	err = L.DoString(`while true do pcall(function() while true do end end) end`)
+	if err == nil || err.(*LuaError).Msg != ExecutionQuantumExceeded {
+		t.Fatalf("Expected the execution limit error on the second call, got: %v", err)
+	}
+	if count != 10 || added != 3 {
+		t.Fatalf("Wrong number of hook calls after an abort: %d %d", count, added)
+	}
+	L.SetTop(0)
+	if err := L.DoString(`x = 1`); err != nil {
+		t.Fatalf("DoString failed after an abort: %v", err)
+	}
+
+	L.RemoveHook(id)
+	L.SetHook(nil, 0)
+	L.SetExecutionLimit(0)
+	if len(L.hooks) != 0 || L.jitSuspended {
+		t.Fatalf("Hooks not removed")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	L, err := NewSandbox(SandboxOptions{Package: true})
+	if err != nil {
+		t.Fatalf("NewSandbox failed: %v", err)
+	}
+	defer L.Close()
+
+	for _, name := range []string{"io", "debug", "dofile", "loadfile", "jit", "ffi", "os.execute", "os.getenv", "package.loadlib"} {
+		if err := L.DoString(`assert(` + name + ` == nil, "` + name + `")`); err != nil {
+			t.Fatalf("%s is available in the sandbox: %v", name, err)
+		}
+	}
+	if err := L.DoString(`assert(string.rep("a", 2) == "aa" and table.concat({1, 2}) == "12" and math.max(1, 2) == 2 and os.time())`); err != nil {
+		t.Fatalf("Library missing in the sandbox: %v", err)
+	}
+	if err := L.DoString(`assert(load("return 1")() == 1 and loadstring("return 2")() == 2)`); err != nil {
+		t.Fatalf("Text chunks not loaded: %v", err)
+	}
+	if err := L.DoString(`assert(not load(string.dump(function() end)))`); err != nil {
+		t.Fatalf("Bytecode loaded in the sandbox: %v", err)
+	}
+	if err := L.DoString(`package.preload.m = function() return 42 end; assert(require("m") == 42)`); err != nil {
+		t.Fatalf("Preloaded module not found: %v", err)
+	}
+	if err := L.DoString(`require("socket.core")`); err == nil {
+		t.Fatal("C module loaded in the sandbox")
+	}
+
+	// limits
+	L, err = NewSandbox(SandboxOptions{MemoryLimit: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewSandbox failed: %v", err)
+	}
+	defer L.Close()
+	if err := L.DoString(`assert(require == nil and package == nil)`); err != nil {
+		t.Fatalf("package is available in the sandbox: %v", err)
+	}
+	err = L.DoString(`local t = {} for i = 1, 1e7 do t[i] = {} end`)
+	if !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("Expected a memory error, got: %v", err)
+	}
+
+	L, err = NewSandbox(SandboxOptions{InstructionLimit: 100000})
+	if err != nil {
+		t.Fatalf("NewSandbox failed: %v", err)
+	}
+	defer L.Close()
+	err = L.DoString(`while true do end`)
+	if err == nil || err.(*LuaError).Msg != ExecutionQuantumExceeded {
+		t.Fatalf("Expected the execution limit error, got: %v", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	before := L.MemoryUsage()
+	L.SetMemoryLimit(before + 512*1024)
+	if used := L.MemoryUsage(); used < before || used > before+1024 {
+		t.Fatalf("Wrong memory usage: %d (%d before the limit)", used, before)
+	}
+	if err := L.DoString(`s = string.rep("x", 1024)`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	if L.MemoryUsage() <= before {
+		t.Fatalf("Allocations not counted: %d", L.MemoryUsage())
+	}
+
+	err := L.DoString(`s = string.rep("x", 1024 * 1024)`)
+	var le *LuaError
+	if !errors.Is(err, ErrMemoryLimit) || !errors.As(err, &le) || le.Code != LUA_ERRMEM {
+		t.Fatalf("Expected a memory limit error, got: %v", err)
+	}
+	if err := L.DoString(`s = nil`); err != nil {
+		t.Fatalf("DoString failed after the memory error: %v", err)
+	}
+	if errors.Is(L.DoString(`error("x")`), ErrMemoryLimit) {
+		t.Fatal("Runtime error matched ErrMemoryLimit")
+	}
+	if errors.Is(&LuaError{Code: LUA_ERRMEM, Msg: "not enough memory"}, ErrMemoryLimit) {
+		t.Fatal("A memory error not caused by the limit matched ErrMemoryLimit")
+	}
+
+	L.SetMemoryLimit(0)
+	if err := L.DoString(`s = string.rep("x", 1024 * 1024)`); err != nil {
+		t.Fatalf("DoString failed without limit: %v", err)
+	}
+	if L.MemoryUsage() < before+1024*1024 {
+		t.Fatalf("Wrong memory usage: %d", L.MemoryUsage())
+	}
+}
+
+func TestDumpFunctionLoadChunk(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	if err := L.LoadChunk([]byte("local a, b = ...\nreturn a * b\n"), "mul", "t"); err != nil {
+		t.Fatalf("LoadChunk failed: %v", err)
+	}
+	full, err := L.DumpFunction(-1, false)
+	if err != nil {
+		t.Fatalf("DumpFunction failed: %v", err)
+	}
+	stripped, err := L.DumpFunction(-1, true)
+	if err != nil {
+		t.Fatalf("DumpFunction failed: %v", err)
+	}
+	if len(stripped) >= len(full) || strings.IndexByte(string(full), 0) < 0 {
+		t.Fatalf("Wrong chunks: %d %d bytes", len(stripped), len(full))
+	}
+	L.Pop(1)
+
+	for _, chunk := range [][]byte{full, stripped} {
+		if err := L.LoadChunk(chunk, "mul", "b"); err != nil {
+			t.Fatalf("LoadChunk failed: %v", err)
+		}
+		L.PushInteger(6)
+		L.PushInteger(7)
+		if err := L.Call(2, 1); err != nil || L.ToInteger(-1) != 42 {
+			t.Fatalf("Wrong result of the loaded chunk: %v %v", err, L.ToInteger(-1))
+		}
+		L.Pop(1)
+	}
+
+	err = L.LoadChunk(full, "mul", "t")
+	if le, ok := err.(*LuaError); !ok || le.Code != LUA_ERRSYNTAX {
+		t.Fatalf("Binary chunk loaded in text mode: %v", err)
+	}
+	if err := L.LoadChunk([]byte("return 1"), "one", "b"); err == nil {
+		t.Fatal("Text chunk loaded in binary mode")
+	}
+	if err := L.LoadChunk([]byte("return"), "empty", "x"); err == nil {
+		t.Fatal("Invalid mode accepted")
+	}
+
+	L.GetGlobal("print")
+	if _, err := L.DumpFunction(-1, false); err == nil {
+		t.Fatal("C function dumped")
+	}
+	L.Pop(1)
+	if L.GetTop() != 0 {
+		t.Fatalf("Stack not empty: %d", L.GetTop())
+	}
+}
+
+func TestCoroutineYield(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	// synchronous yield: the values passed to resume are the results of the go function
+	L.Register("goyield", func(L *State) int {
+		L.PushInteger(int64(L.CheckInteger(1) * 10))
+		return L.Yield(1)
+	})
+	err := L.DoString(`
+		local function gen(n)
+			return coroutine.wrap(function()
+				local sum = 0
+				for i = 1, n do
+					sum = sum + goyield(i)
+				end
+				return "sum", sum
+			end)
+		end
+		local g = gen(3)
+		assert(g() == 10)
+		assert(g(1) == 20)
+		assert(g(2) == 30)
+		local s, sum = g(3)
+		assert(s == "sum" and sum == 6, sum)
+
+		-- nested coroutines yielding from go
+		local outer = coroutine.create(function()
+			local inner = coroutine.create(function()
+				local r = goyield(1)
+				goyield(r + 1)
+			end)
+			local _, v1 = coroutine.resume(inner)
+			local _, v2 = coroutine.resume(inner, 5)
+			local r = goyield(v1 + v2)
+			assert(coroutine.resume(inner))
+			assert(coroutine.status(inner) == "dead")
+			return r
+		end)
+		local ok, v = coroutine.resume(outer)
+		assert(ok and v == 700, v)
+		ok, v = coroutine.resume(outer, "done")
+		assert(ok and v == "done" and coroutine.status(outer) == "dead", v)
+
+		-- errors
+		local co = coroutine.create(function() goyield({}) end)
+		ok, v = coroutine.resume(co)
+		assert(not ok and v:find("bad argument"), v)
+		ok, v = pcall(goyield, 1)
+		assert(not ok and v:find("outside a coroutine"), v)
+	`)
+	if err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+}
+
+func TestCoroutineYieldWith(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	L.Register("fetch", func(L *State) int {
+		key := L.CheckString(1)
+		return L.YieldWith(func(resume func(results ...interface{})) {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				resume("value of "+key, len(key))
+			}()
+		})
+	})
+	if err := L.DoString(`
+		function job(a, b)
+			local v1, n1 = fetch(a)
+			local v2, n2 = fetch(b)
+			return v1 .. ", " .. v2, n1 + n2
+		end
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+
+	co := L.NewThread()
+	co.GetGlobal("job")
+	co.PushString("a")
+	co.PushString("bc")
+	status := co.Resume(2)
+	yields := 0
+	for status == LUA_YIELD {
+		yields++
+		select {
+		case <-co.Resumable():
+		case <-time.After(time.Second):
+			t.Fatal("resume not called")
+		}
+		status = co.Resume(0)
+	}
+	if status != 0 || yields != 2 {
+		t.Fatalf("Wrong resume status: %d after %d yields: %s", status, yields, co.ToString(-1))
+	}
+	if co.GetTop() != 2 || co.ToString(1) != "value of a, value of bc" || co.ToInteger(2) != 3 {
+		t.Fatalf("Wrong results: %d %s %d", co.GetTop(), co.ToString(1), co.ToInteger(2))
+	}
+
+	L.Register("bad", func(L *State) int {
+		return L.YieldWith(func(resume func(results ...interface{})) {
+			resume("ok", make(chan int))
+		})
+	})
+	co = L.NewThread()
+	co.LoadString(`local v = bad() return v`)
+	if status := co.Resume(0); status != LUA_YIELD {
+		t.Fatalf("Wrong resume status: %d", status)
+	}
+	status = co.Resume(0)
+	if status != LUA_ERRRUN || !strings.Contains(co.ToString(-1), "bad result #2") {
+		t.Fatalf("the conversion error should be returned, got %d: %s", status, co.ToString(-1))
+	}
+	co.SetTop(0)
+	co.PushString("retry")
+	if status := co.Resume(1); status != 0 || co.ToString(-1) != "retry" {
+		t.Fatalf("the coroutine should stay suspended, got %d: %s", status, co.ToString(-1))
+	}
+
+	// nested coroutines: the lua coroutines keep working within a coroutine
+	// using YieldWith, those using YieldWith can only be resumed from go
+	if err := L.DoString(`
+		function nested(key)
+			local inner = coroutine.wrap(function(k)
+				coroutine.yield(k .. 1)
+				coroutine.yield(k .. 2)
+			end)
+			local parts = inner(key) .. inner()
+			return parts .. ", " .. fetch(key)
+		end
+		function resumedbylua(key)
+			local inner = coroutine.create(function(k) return fetch(k) end)
+			assert(coroutine.resume(inner, key))
+			local ok, err = coroutine.resume(inner, "from lua")
+			assert(not ok and err:find("suspended by YieldWith"), tostring(err))
+			local wrapped = coroutine.wrap(function(k) return fetch(k) end)
+			wrapped(key)
+			ok, err = pcall(wrapped, "from lua")
+			assert(not ok and err:find("suspended by YieldWith"), tostring(err))
+			coroutine.yield(inner)
+			return "done"
+		end
+	`); err != nil {
+		t.Fatalf("DoString failed: %v", err)
+	}
+	co = L.NewThread()
+	co.GetGlobal("nested")
+	co.PushString("x")
+	status = co.Resume(1)
+	for status == LUA_YIELD {
+		<-co.Resumable()
+		status = co.Resume(0)
+	}
+	if status != 0 || co.ToString(-1) != "x1x2, value of x" {
+		t.Fatalf("Wrong nested results: %d %s", status, co.ToString(-1))
+	}
+
+	co = L.NewThread()
+	co.GetGlobal("resumedbylua")
+	co.PushString("y")
+	if status := co.Resume(1); status != LUA_YIELD || !co.IsThread(-1) {
+		t.Fatalf("the inner coroutine should be yielded, got %d: %s", status, co.ToString(-1))
+	}
+	inner := co.ToThread(-1)
+	defer inner.Release()
+	<-inner.Resumable()
+	if status := inner.Resume(0); status != 0 || inner.ToString(1) != "value of y" || inner.ToInteger(2) != 1 {
+		t.Fatalf("Wrong inner results: %d %s", status, inner.ToString(-1))
+	}
+	co.Pop(1)
+	if status := co.Resume(0); status != 0 || co.ToString(-1) != "done" {
+		t.Fatalf("Wrong resume status: %d %s", status, co.ToString(-1))
+	}
+}
+
+func TestPool(t *testing.T) {
+	inits := 0
+	p, err := NewPool(PoolOptions{
+		Init: func(L *State) error {
+			inits++
+			L.PushInteger(42)
+			L.SetGlobal("answer")
+			return L.DoString(`package.preload.mod = function() return {n = 0} end`)
+		},
+		Preload:   []string{"mod"},
+		MaxStates: 1,
+		WarmUp:    1,
+	})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer p.Close()
+	if inits != 1 {
+		t.Fatalf("expected 1 warmed up state, got %d", inits)
+	}
+
+	ctx := context.Background()
+	L, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if err := L.DoString(`
+		assert(answer == 42)
+		answer, leaked = 1, true
+		require("mod").n = 1
+		require("mod").added = true
+		package.loaded.other = {}
+		string.upper = nil
+		setmetatable(_G, {__index = function(t, k) return "leaked " .. k end})
+		getmetatable("").__index = {}
+	`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	// the pool is full
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	// the errors handled by go don't evict the state
+	if err := L.DoString(`strict = setmetatable({}, {__index = function(t, k) error("no field " .. k) end})`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	if v, err := L.Globals().Get("strict"); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	} else if _, err := v.(*Table).Get("x"); err == nil || !strings.Contains(err.Error(), "no field x") {
+		t.Fatalf("Get should have failed, got %v", err)
+	}
+	L.Register("handled", func(L *State) int {
+		if err := L.DoString(`error("handled")`); err == nil {
+			L.RaiseError("the error was not returned")
+		}
+		return 0
+	})
+	if err := L.DoString(`handled()`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	p.Put(L)
+	L2, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if L2 != L {
+		t.Fatal("the state should have been reused")
+	}
+	// the content of the module tables is restored too
+	if err := L2.DoString(`
+		assert(answer == 42 and leaked == nil)
+		assert(package.loaded.other == nil)
+		assert(require("mod").n == 0 and require("mod").added == nil)
+		assert(string.upper("a") == "A" and ("a"):upper() == "A")
+		assert(getmetatable(_G) == nil and undefined == nil)
+		error("boom")
+	`); err == nil || !strings.Contains(err.(*LuaError).Msg, "boom") {
+		t.Fatalf("DoString should have failed with boom, got %v", err)
+	}
+	p.Put(L2)
+
+	// the failed state has been evicted
+	L3, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if L3 == L2 || inits != 2 {
+		t.Fatalf("the failed state should have been replaced (%d inits)", inits)
+	}
+	L3.SetExecutionLimit(1000)
+	if err := L3.DoString(`while true do end`); err == nil {
+		t.Fatal("the execution limit should have been reached")
+	}
+	p.Put(L3)
+
+	L4, err := p.Get(ctx)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if L4 == L3 || inits != 3 {
+		t.Fatalf("the aborted state should have been replaced (%d inits)", inits)
+	}
+	p.Put(L4)
+
+	p.Close()
+	if _, err := p.Get(ctx); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestRef(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	if err := L.DoString(`return function(a, b) return a + b, "sum" end`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	ref := L.NewRef(-1)
+	L.Pop(1)
+	if ref.Type() != LUA_TFUNCTION {
+		t.Fatalf("expected a function, got %v", ref.Type())
+	}
+	res, err := ref.Call(1, 2)
+	if err != nil {
+		t.Fatalf("Call returned an error: %v", err)
+	}
+	if len(res) != 2 || res[0] != 3.0 || res[1] != "sum" {
+		t.Fatalf("unexpected results: %v", res)
+	}
+	if _, err := ref.Call(1, nil); err == nil {
+		t.Fatal("Call should have failed")
+	}
+	if L.GetTop() != 0 {
+		t.Fatalf("the stack should be empty, got %d values", L.GetTop())
+	}
+
+	ref.Push()
+	L.SetGlobal("add")
+	if err := L.DoString(`assert(add(2, 3) == 5)`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	ref.Release()
+	ref.Release()
+	if ref.Type() != LUA_TNONE {
+		t.Fatalf("a released reference should have no type, got %v", ref.Type())
+	}
+	ref.Push()
+	if !L.IsNil(-1) {
+		t.Fatal("a released reference should push nil")
+	}
+	L.Pop(1)
+
+	// the reference of a collected Ref is reused once released by the finalizer
+	L.NewTable()
+	n := L.NewRef(-1).SetFinalizer().ref
+	L.Pop(1)
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		L.MainCo.deadRefsMu.Lock()
+		done := len(L.MainCo.deadRefs) > 0
+		L.MainCo.deadRefsMu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	L.NewTable()
+	r2 := L.NewRef(-1)
+	if r2.ref != n {
+		t.Fatalf("expected the reference %d to be reused, got %d", n, r2.ref)
+	}
+
+	L.Close()
+	r2.Release()
+}
+
+func TestTable(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	err := L.DoString(`
+		t = setmetatable({1, 2, name = "t", inner = {x = 1}, f = print}, {
+			__index = function(t, k) return "default" end,
+		})
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	top := L.GetTop()
+	g := L.Globals()
+	v, err := g.Get("t")
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	tbl, ok := v.(*Table)
+	if !ok {
+		t.Fatalf("expected a *Table, got %T", v)
+	}
+	defer tbl.Release()
+
+	if v, _ := tbl.Get("name"); v != "t" {
+		t.Fatalf("unexpected name: %v", v)
+	}
+	if v, _ := tbl.Get("missing"); v != "default" {
+		t.Fatalf("Get should call __index, got %v", v)
+	}
+	if v, _ := tbl.RawGet("missing"); v != nil {
+		t.Fatalf("RawGet should not call __index, got %v", v)
+	}
+	if v, _ := tbl.Get(2); v != 2.0 {
+		t.Fatalf("unexpected t[2]: %v", v)
+	}
+	if v, _ := tbl.Get("f"); v.(*Function).Type() != LUA_TFUNCTION {
+		t.Fatalf("expected a function reference, got %v", v)
+	}
+	v, _ = tbl.Get("inner")
+	if x, _ := v.(*Table).Get("x"); x != 1.0 {
+		t.Fatalf("unexpected inner.x: %v", x)
+	}
+
+	if err := tbl.Append("three"); err != nil {
+		t.Fatalf("Append returned an error: %v", err)
+	}
+	if err := tbl.Set("copy", v); err != nil {
+		t.Fatalf("Set returned an error: %v", err)
+	}
+	if err := tbl.RawSet("list", []int{1, 2}); err != nil {
+		t.Fatalf("RawSet returned an error: %v", err)
+	}
+	if err := tbl.Set("bad", make(chan int)); err == nil {
+		t.Fatal("Set should fail on unsupported values")
+	}
+	if n := tbl.Len(); n != 3 {
+		t.Fatalf("expected a length of 3, got %d", n)
+	}
+	if n := len(tbl.Keys()); n != 8 {
+		t.Fatalf("expected 8 keys, got %d", n)
+	}
+	count := 0
+	tbl.ForEach(func(k, v Value) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Fatalf("ForEach should stop when f returns false, got %d calls", count)
+	}
+	if err := tbl.Set(nil, 1); err == nil {
+		t.Fatal("Set should fail on a nil key")
+	}
+	if err := tbl.RawSet(math.NaN(), 1); err == nil {
+		t.Fatal("RawSet should fail on a NaN key")
+	}
+	err = L.DoString(`strict = setmetatable({}, {__index = function(t, k) error("no field " .. k) end})`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	v, _ = g.Get("strict")
+	strict := v.(*Table)
+	defer strict.Release()
+	if _, err := strict.Get("x"); err == nil || !strings.Contains(err.Error(), "no field x") {
+		t.Fatalf("Get should return the error of __index, got %v", err)
+	} else if _, ok := err.(*LuaError); !ok {
+		t.Fatalf("expected a *LuaError, got %T", err)
+	}
+	if L.GetTop() != top {
+		t.Fatalf("the stack should be unchanged, got %d values instead of %d", L.GetTop(), top)
+	}
+
+	err = L.DoString(`
+		assert(t[3] == "three" and t.copy == t.inner and t.list[2] == 2)
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	var dst *Table
+	L.GetGlobal("t")
+	if err := L.ToValue(-1, &dst); err != nil || dst.Len() != 3 {
+		t.Fatalf("ToValue into a *Table failed: %v", err)
+	}
+	L.Pop(1)
+
+	tbl.Release()
+	if _, err := tbl.Get(1); err == nil {
+		t.Fatal("Get should fail on a released table")
+	}
+}
+
+func TestCallFunction(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	err := L.DoString(`
+		hooks = {}
+		function hooks.on_event(name, data)
+			if not name then error("no name") end
+			return name .. ":" .. data.id, {ok = true}, function() return data.id end
+		end
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	res, err := L.CallFunction("hooks.on_event", "start", map[string]int{"id": 7})
+	if err != nil {
+		t.Fatalf("CallFunction returned an error: %v", err)
+	}
+	if len(res) != 3 || res[0] != "start:7" {
+		t.Fatalf("unexpected results: %v", res)
+	}
+	if m, ok := res[1].(map[string]interface{}); !ok || m["ok"] != true {
+		t.Fatalf("expected the table to be converted into a map, got %#v", res[1])
+	}
+	f, ok := res[2].(*Function)
+	if !ok {
+		t.Fatalf("expected a *Function, got %T", res[2])
+	}
+	if r, err := f.Call(); err != nil || len(r) != 1 || r[0] != 7.0 {
+		t.Fatalf("unexpected call of the returned function: %v %v", r, err)
+	}
+	f.Release()
+
+	if _, err := L.CallFunction("hooks.on_event"); err == nil || !strings.Contains(err.Error(), "no name") {
+		t.Fatalf("expected the lua error, got %v", err)
+	}
+	if _, err := L.CallFunction("hooks.missing"); err == nil {
+		t.Fatal("CallFunction should fail on a missing function")
+	}
+	if _, err := L.CallFunction("nothing.on_event"); err == nil {
+		t.Fatal("CallFunction should fail on a missing table")
+	}
+
+	format, err := L.GetFunction("string.format")
+	if err != nil {
+		t.Fatalf("GetFunction returned an error: %v", err)
+	}
+	defer format.Release()
+	if r, err := format.Call("%d-%s", 1, "a"); err != nil || r[0] != "1-a" {
+		t.Fatalf("unexpected call of string.format: %v %v", r, err)
+	}
+
+	err = L.DoString(`setmetatable(_G, {__index = function(t, k) error("undefined global " .. k) end})`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	if _, err := L.CallFunction("missing"); err == nil || !strings.Contains(err.Error(), "undefined global missing") {
+		t.Fatalf("CallFunction should return the error of __index, got %v", err)
+	}
+	if _, err := L.GetFunction("missing"); err == nil {
+		t.Fatal("GetFunction should return the error of __index")
+	}
+	if L.GetTop() != 0 {
+		t.Fatalf("the stack should be empty, got %d values", L.GetTop())
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	err := L.RegisterFunc("check", func(s string, n int) (bool, error) {
+		if n < 0 {
+			return false, errors.New("negative count")
+		}
+		return len(s) == n, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterFunc returned an error: %v", err)
+	}
+	L.RegisterFunc("join", func(sep string, parts ...string) (string, int) {
+		return strings.Join(parts, sep), len(parts)
+	})
+	L.RegisterFunc("raw", func(L *State) int {
+		L.PushInteger(int64(L.GetTop()))
+		return 1
+	})
+	if err := L.RegisterFunc("bad", 42); err == nil {
+		t.Fatal("RegisterFunc should fail on non functions")
+	}
+
+	err = L.DoString(`
+		assert(check("abc", 3) == true)
+		assert(check("abc", 2) == false)
+		local s, n = join(",", "a", "b", "c")
+		assert(s == "a,b,c" and n == 3)
+		s, n = join("-")
+		assert(s == "" and n == 0)
+		assert(raw(1, 2) == 2)
+
+		local ok, err = pcall(check, "abc", -1)
+		assert(not ok and err:find("negative count"), err)
+		ok, err = pcall(check, "abc", "x")
+		assert(not ok and err:find("bad argument #2 to 'check' %(int expected, got string%)"), err)
+		ok, err = pcall(check, "abc")
+		assert(not ok and err:find("bad argument #2 to 'check' %(int expected, got no value%)"), err)
+		ok, err = pcall(join, ",", "a", {})
+		assert(not ok and err:find("bad argument #3 to 'join'"), err)
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	loads := 0
+	funcs := map[string]LuaGoFunction{
+		"get": func(L *State) int {
+			loads++
+			L.PushString("GET " + L.CheckString(1))
+			return 1
+		},
+	}
+	fields := map[string]interface{}{
+		"version": "1.2",
+		"codes":   []int{200, 404},
+	}
+	if err := L.RegisterModule("company.http", funcs, fields); err != nil {
+		t.Fatalf("RegisterModule returned an error: %v", err)
+	}
+	delete(funcs, "get")
+
+	err := L.DoString(`
+		assert(company == nil)
+		local http = require("company.http")
+		assert(type(http.get) == "function" and http.get("/") == "GET /")
+		assert(http.version == "1.2" and http.codes[2] == 404)
+		assert(require("company.http") == http)
+		assert(package.loaded["company.http"] == http)
+		assert(company == nil)
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	if loads != 1 {
+		t.Fatalf("expected one call, got %d", loads)
+	}
+
+	L.RegisterModule("broken", nil, map[string]interface{}{"c": make(chan int)})
+	if err := L.DoString(`require("broken")`); err == nil || !strings.Contains(err.Error(), "field 'c'") {
+		t.Fatalf("expected a conversion error, got %v", err)
+	}
+
+	L2, _ := NewSandbox(SandboxOptions{})
+	defer L2.Close()
+	if err := L2.RegisterModule("m", nil, nil); err == nil {
+		t.Fatal("RegisterModule should fail without the package library")
+	}
+}
+
+func TestAddModuleFS(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	fsys := fstest.MapFS{
+		"a/b/c.lua":     {Data: []byte(`return {name = ..., fail = function() error("from c") end}`)},
+		"pkg/init.lua":  {Data: []byte(`return {sub = require("pkg.sub")}`)},
+		"pkg/sub.lua":   {Data: []byte(`return "sub"`)},
+		"broken.lua":    {Data: []byte(`return {`)},
+		"lib/extra.lua": {Data: []byte(`return "extra"`)},
+	}
+	if err := L.AddModuleFS(fsys, ""); err != nil {
+		t.Fatalf("AddModuleFS returned an error: %v", err)
+	}
+	if err := L.AddModuleFS(fsys, "lib/?.lua"); err != nil {
+		t.Fatalf("AddModuleFS returned an error: %v", err)
+	}
+
+	err := L.DoString(`
+		local c = require("a.b.c")
+		assert(c.name == "a.b.c")
+		assert(require("pkg").sub == "sub")
+		assert(require("extra") == "extra")
+
+		local ok, err = pcall(c.fail)
+		assert(not ok and err:find("^a/b/c.lua:1: from c"), err)
+		ok, err = pcall(require, "broken")
+		assert(not ok and err:find("error loading module 'broken' from file 'broken.lua'"), err)
+		ok, err = pcall(require, "missing")
+		assert(not ok and err:find("no file 'missing.lua' in fs"), err)
+		assert(err:find("no file 'missing/init.lua' in fs"), err)
+		assert(err:find("no file 'lib/missing.lua' in fs"), err)
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+}
+
+func TestOpenLibsWithOptions(t *testing.T) {
+	AddBundledModule("golua_test_bundled", []byte(`return {args = arg}`))
+	t.Cleanup(func() { RemoveBundledModule("golua_test_bundled") })
+	found := false
+	for _, name := range BundledModules() {
+		found = found || name == "golua_test_bundled"
+	}
+	if !found {
+		t.Fatalf("the added module should be listed: %v", BundledModules())
+	}
+
+	L := NewState()
+	defer L.Close()
+	L.OpenLibsWithOptions(LibOptions{Bundle: true, Args: []string{"prog", "-v"}})
+	err := L.DoString(`
+		local m = require("golua_test_bundled")
+		assert(m.args[0] == "prog" and m.args[1] == "-v" and #m.args == 1)
+		local ok, err = pcall(require, "golua_test_missing")
+		assert(not ok and err:find("no module 'golua_test_missing' in bundle"), err)
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	L2 := NewState()
+	defer L2.Close()
+	L2.OpenLibsWithOptions(LibOptions{})
+	err = L2.DoString(`
+		assert(arg == nil)
+		assert(not pcall(require, "golua_test_bundled"))
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	RemoveBundledModule("golua_test_bundled")
+	for _, name := range BundledModules() {
+		if name == "golua_test_bundled" {
+			t.Fatal("the removed module should not be listed")
+		}
+	}
+	L3 := NewState()
+	defer L3.Close()
+	L3.OpenLibsWithOptions(LibOptions{Bundle: true})
+	if err := L3.DoString(`assert(not pcall(require, "golua_test_bundled"))`); err != nil {
+		t.Fatalf("the removed module should not be required: %v", err)
+	}
+}
+
+type testCodeError struct{ code int }
+
+func (e *testCodeError) Error() string { return fmt.Sprintf("code %d", e.code) }
+
+func TestRaiseGoError(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	errSentinel := errors.New("sentinel")
+	L.Register("raise", func(L *State) int {
+		L.RaiseGoError(fmt.Errorf("wrapped: %w", errSentinel))
+		return 0
+	})
+	L.RegisterE("fail", func(L *State) (int, error) {
+		return 0, &testCodeError{42}
+	})
+	L.RegisterFunc("check", func(ok bool) error {
+		if !ok {
+			return errSentinel
+		}
+		return nil
+	})
+
+	unwrapped := func(script string) {
+		t.Helper()
+		err := L.DoString(script)
+		if !errors.Is(err, errSentinel) {
+			t.Fatalf("%s: the error should unwrap to the sentinel, got %v", script, err)
+		}
+		var le *LuaError
+		if !errors.As(err, &le) || le.Code != LUA_ERRRUN {
+			t.Fatalf("%s: expected a *LuaError, got %v", script, err)
+		}
+	}
+	for _, script := range []string{
+		`raise()`,
+		`check(false)`,
+		`local function f() raise() end local function g() f() end g()`,
+	} {
+		unwrapped(script)
+	}
+
+	err := L.DoString(`fail()`)
+	var ce *testCodeError
+	if !errors.As(err, &ce) || ce.code != 42 {
+		t.Fatalf("the error should unwrap to the *testCodeError, got %v", err)
+	}
+	err = L.DoString(`
+		local ok, err = pcall(fail)
+		assert(type(err) == "string" and err == "code 42" and string.find(err, "42"))
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+
+	err = L.DoString(`error("from lua")`)
+	if err == nil || errors.Unwrap(err) != nil {
+		t.Fatalf("a lua error should not unwrap, got %v", err)
+	}
+	for _, script := range []string{
+		`local ok, err = pcall(raise) error(err, 0)`,
+		`pcall(raise) error("other")`,
+		`pcall(raise) local t = nil; t.x = 1`,
+	} {
+		if err := L.DoString(script); err == nil || errors.Unwrap(err) != nil {
+			t.Fatalf("%s: an error raised by lua should not unwrap, got %v", script, err)
+		}
+	}
+
+	// the errors raised again by lua keep their Go error as values
+	L.SetGoErrorValues(true)
+	for _, script := range []string{
+		`raise()`,
+		`local ok, err = pcall(raise) error(err, 0)`,
+		`local ok, err = pcall(check, false) error(err)`,
+		`local ok, err = pcall(function() local ok, err = pcall(raise) error(err) end) error(err)`,
+	} {
+		unwrapped(script)
+	}
+	err = L.DoString(`
+		local ok, err = pcall(fail)
+		assert(type(err) == "userdata" and tostring(err) == "code 42")
+		assert("failed: " .. err == "failed: code 42" and err .. "!" == "code 42!")
+		assert(getmetatable(err) == false)
+		assert(err:find("code 42") and err:upper() == "CODE 42")
+	`)
+	if err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	err = L.DoString(`pcall(raise) error("wrapped: sentinel", 0)`)
+	if err == nil || errors.Unwrap(err) != nil {
+		t.Fatalf("a lua error with the message of a Go error should not unwrap, got %v", err)
+	}
+	err = L.DoString(`local ok, err = pcall(raise) error(err)`)
+	var le *LuaError
+	if !errors.As(err, &le) || le.Msg != "wrapped: sentinel" || le.Ref() != nil || le.Value() != le.Msg {
+		t.Fatalf("a raised Go error should keep its message, got %v", err)
+	}
+}
+
+func TestErrorValue(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	err := L.DoString(`error({code = 404, msg = "not found"})`)
+	var le *LuaError
+	if !errors.As(err, &le) {
+		t.Fatalf("expected a *LuaError, got %v", err)
+	}
+	if le.Msg != "(error object is a table value)" {
+		t.Fatalf("unexpected message: %q", le.Msg)
+	}
+	tbl, ok := le.Value().(*Table)
+	if !ok {
+		t.Fatalf("expected a table value, got %T", le.Value())
+	}
+	if code, _ := tbl.Get("code"); code != 404.0 {
+		t.Fatalf("unexpected code: %v", code)
+	}
+	if le.Ref() == nil || le.Ref().Type() != LUA_TTABLE {
+		t.Fatal("the error should reference the table")
+	}
+
+	type httpError struct {
+		Code int    `lua:"code"`
+		Msg  string `lua:"msg"`
+	}
+	L.Register("fail", func(L *State) int {
+		L.RaiseErrorValue(httpError{500, "internal"})
+		return 0
+	})
+	err = L.DoString(`
+		local ok, err = pcall(fail)
+		assert(not ok and type(err) == "table" and err.code == 500 and err.msg == "internal")
+		fail()
+	`)
+	if !errors.As(err, &le) {
+		t.Fatalf("expected a *LuaError, got %v", err)
+	}
+	var he httpError
+	le.Ref().Push()
+	if err := L.ToValue(-1, &he); err != nil || he.Code != 500 {
+		t.Fatalf("unexpected error value: %v %v", he, err)
+	}
+	L.Pop(1)
+
+	err = L.DoString(`error("plain", 0)`)
+	if !errors.As(err, &le) || le.Ref() != nil || le.Value() != "plain" {
+		t.Fatalf("a string error should have its message as value, got %v", err)
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	var checked bool
+	L.Register("inspect", func(L *State) int {
+		if checked {
+			return 0
+		}
+		if ar := L.GetStack(0); ar == nil || !L.GetInfo("nSl", ar) || ar.What != "C" {
+			t.Errorf("level 0 should be the go function, got %+v", ar)
+		}
+		ar := L.GetStack(1)
+		if ar == nil || !L.GetInfo("nSlu", ar) {
+			t.Fatal("GetStack(1) should return the caller")
+		}
+		if ar.Name != "handler" || ar.What != "Lua" || ar.ShortSrc != "test.lua" || ar.CurrentLine != 4 || ar.LineDefined != 2 {
+			t.Errorf("unexpected caller info: %+v", ar)
+		}
+		if L.GetInfo("?", ar) {
+			t.Error("GetInfo should fail on an invalid option")
+		}
+		if L.GetInfo("nSl", &DebugInfo{}) {
+			t.Error("GetInfo should fail on an activation record not returned by GetStack")
+		}
+
+		locals := map[string]interface{}{}
+		for n := 1; ; n++ {
+			name, ok := L.GetLocal(ar, n)
+			if !ok {
+				break
+			}
+			var v interface{}
+			L.ToValue(-1, &v)
+			L.Pop(1)
+			locals[name] = v
+		}
+		if locals["req"] != "GET" || locals["count"] != 2.0 {
+			t.Errorf("unexpected locals: %v", locals)
+		}
+
+		top := L.GetTop()
+		L.PushString("POST")
+		if name, ok := L.SetLocal(ar, 1); !ok || name != "req" {
+			t.Errorf("SetLocal should set req, got %q", name)
+		}
+		L.PushNil()
+		if _, ok := L.SetLocal(ar, 100); ok {
+			t.Error("SetLocal should fail on a missing local")
+		}
+		if L.GetTop() != top {
+			t.Errorf("SetLocal should pop the value, the top is %d instead of %d", L.GetTop(), top)
+		}
+		if L.GetStack(100) != nil {
+			t.Error("GetStack should return nil past the stack depth")
+		}
+		checked = true
+		return 0
+	})
+
+	err := L.LoadChunk([]byte(`local prefix = ">"
+local function handler(req)
+	local count = 2
+	inspect()
+	return prefix .. req
+end
+return handler("GET"), handler`), "@test.lua", "t")
+	if err != nil {
+		t.Fatalf("LoadChunk returned an error: %v", err)
+	}
+	if err := L.Call(0, 2); err != nil {
+		t.Fatalf("Call returned an error: %v", err)
+	}
+	if !checked || L.ToString(-2) != ">POST" {
+		t.Fatalf("the local should have been changed, got %q", L.ToString(-2))
+	}
+
+	ar := L.GetInfoForFunction(-1)
+	if ar == nil || ar.What != "Lua" || ar.LineDefined != 2 || ar.LastLineDefined != 6 || ar.NUps != 1 {
+		t.Fatalf("unexpected function info: %+v", ar)
+	}
+	if _, ok := L.GetLocal(ar, 1); ok {
+		t.Fatal("GetLocal needs a record of GetStack")
+	}
+	if name, ok := L.GetUpvalue(-1, 1); !ok || name != "prefix" || L.ToString(-1) != ">" {
+		t.Fatalf("unexpected upvalue %q", name)
+	}
+	L.Pop(1)
+	L.PushString("<")
+	if name, ok := L.SetUpvalue(-2, 1); !ok || name != "prefix" {
+		t.Fatalf("SetUpvalue should set prefix, got %q", name)
+	}
+	if _, ok := L.GetUpvalue(-1, 2); ok {
+		t.Fatal("GetUpvalue should fail on a missing upvalue")
+	}
+	L.SetGlobal("handler")
+	if err := L.DoString(`local s = handler("x") assert(s == "<x", s)`); err != nil {
+		t.Fatalf("DoString returned an error: %v", err)
+	}
+	if L.GetInfoForFunction(1) != nil {
+		t.Fatal("GetInfoForFunction should return nil for non functions")
+	}
+}